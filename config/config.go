@@ -0,0 +1,161 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package config implements the means of loading a JSON configuration file
+// to be used by all submodules of Chihaya.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+// Duration wraps a time.Duration and adds JSON marshalling support so
+// configuration files can express durations as either a number of
+// nanoseconds or a parseable string such as "30s".
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON transforms a duration to JSON.
+func (d *Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON transform a JSON field into a Duration.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	switch value := v.(type) {
+	case float64:
+		d.Duration = time.Duration(value)
+		return nil
+	case string:
+		var err error
+		d.Duration, err = time.ParseDuration(value)
+		return err
+	default:
+		return errors.New("config: invalid duration")
+	}
+}
+
+// CacheConfig is the configuration used to connect to and query a Redis
+// storage backend, as registered under the "redis" name for
+// Config.StorageDriver.
+type CacheConfig struct {
+	Network      string   `json:"network"`
+	Addr         string   `json:"addr"`
+	Password     string   `json:"password,omitempty"`
+	MaxIdleConns int      `json:"max_idle_conns"`
+	IdleTimeout  Duration `json:"idle_timeout"`
+	Prefix       string   `json:"prefix"`
+}
+
+// UDPConfig is the configuration used by the BitTorrent UDP tracker
+// protocol (BEP 15) server.
+type UDPConfig struct {
+	ListenAddr string `json:"udp_listen_addr"`
+
+	// ConnectionIDTTL controls how long a connection ID handed out by a
+	// connect request remains valid for subsequent announce/scrape
+	// requests, per BEP 15's recommendation of about two minutes.
+	ConnectionIDTTL Duration `json:"connection_id_ttl"`
+
+	// AnnounceInterval is advertised to clients as the number of seconds
+	// they should wait before re-announcing.
+	AnnounceInterval Duration `json:"announce_interval"`
+
+	// MaxAnnounceRate and MaxConnectRate cap the number of announce and
+	// connect requests, respectively, accepted per source IP per second,
+	// to mitigate the protocol's use in UDP reflection/amplification
+	// abuse.
+	MaxAnnounceRate int `json:"max_announce_rate"`
+	MaxConnectRate  int `json:"max_connect_rate"`
+}
+
+// StatsConfig is the configuration for the optional metrics HTTP endpoint.
+type StatsConfig struct {
+	// Enabled turns on the /metrics (and, if Expvar is set, /debug/vars)
+	// HTTP endpoint.
+	Enabled bool `json:"enabled"`
+
+	ListenAddr string `json:"listen_addr"`
+
+	// Expvar additionally exposes the same counters in the standard
+	// library's expvar format, for operators who'd rather scrape that
+	// than run a Prometheus server.
+	Expvar bool `json:"expvar"`
+
+	// SampleInterval controls how often the tracker-domain gauges (total
+	// torrents, seeders, leechers) are recomputed by scanning the
+	// storage backend.
+	SampleInterval Duration `json:"sample_interval"`
+}
+
+// Config is the base configuration for a Chihaya tracker instance.
+type Config struct {
+	// StorageDriver names the storage.tracker.Driver to use, as
+	// registered by that driver's package (e.g. "redis" or "memory").
+	StorageDriver string `json:"storage_driver"`
+
+	// Private puts the tracker in private mode: announces are rejected
+	// unless they carry a known user passkey and a whitelisted client.
+	Private bool `json:"private"`
+
+	Cache CacheConfig `json:"cache"`
+	UDP   UDPConfig   `json:"udp"`
+	Stats StatsConfig `json:"stats"`
+}
+
+// DefaultConfig is a reasonable configuration used whenever no config path
+// is supplied.
+var DefaultConfig = Config{
+	StorageDriver: "redis",
+	Cache: CacheConfig{
+		Network:      "tcp",
+		Addr:         "127.0.0.1:6379",
+		MaxIdleConns: 8,
+		IdleTimeout:  Duration{30 * time.Second},
+		Prefix:       "chihaya:",
+	},
+	UDP: UDPConfig{
+		ListenAddr:       ":6969",
+		ConnectionIDTTL:  Duration{2 * time.Minute},
+		AnnounceInterval: Duration{30 * time.Minute},
+		MaxAnnounceRate:  10,
+		MaxConnectRate:   5,
+	},
+	Stats: StatsConfig{
+		Enabled:        false,
+		ListenAddr:     ":6880",
+		SampleInterval: Duration{1 * time.Minute},
+	},
+}
+
+// Open loads a Config from the JSON file located at path. An empty path
+// returns DefaultConfig.
+func Open(path string) (*Config, error) {
+	if path == "" {
+		cfg := DefaultConfig
+		return &cfg, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cfg Config
+	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
@@ -0,0 +1,21 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package udp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+)
+
+// newConnectionID returns a cryptographically random 64-bit value, used
+// both as a handed-out connection ID and, when a torrent is first seen, as
+// its storage ID.
+func newConnectionID() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
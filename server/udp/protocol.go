@@ -0,0 +1,237 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package udp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// protocolID is the magic constant that must open every connect request,
+// as specified by BEP 15.
+const protocolID int64 = 0x41727101980
+
+// Action identifies the kind of UDP tracker request or response.
+type Action int32
+
+const (
+	ActionConnect Action = iota
+	ActionAnnounce
+	ActionScrape
+	ActionError
+)
+
+// Event mirrors the HTTP announce "event" parameter.
+type Event int32
+
+const (
+	EventNone Event = iota
+	EventCompleted
+	EventStarted
+	EventStopped
+)
+
+const (
+	connectRequestLen  = 16
+	announceRequestLen = 98
+	// scrapeRequestLen is the length of a scrape request's fixed header,
+	// before its info_hashes; each info_hash adds 20 bytes.
+	scrapeRequestLen = 16
+	infoHashLen      = 20
+	peerIDLen        = 20
+
+	// passkeyLen is the length of the passkey this tracker's private-mode
+	// extension to BEP 15 expects a client to append after the standard
+	// 98-byte announce body; the core protocol has no field for
+	// authenticating the announcing user.
+	passkeyLen = 20
+
+	// maxScrapeInfoHashes is the limit BEP 15 places on the number of
+	// info_hashes a single scrape request may carry.
+	maxScrapeInfoHashes = 74
+)
+
+var (
+	errMalformedPacket   = errors.New("udp: malformed packet")
+	errUnknownAction     = errors.New("udp: unknown action")
+	errBadProtocolID     = errors.New("udp: bad protocol id")
+	errTooManyInfoHashes = errors.New("udp: too many info_hashes in scrape request")
+)
+
+// header is shared by every request after the initial connect handshake.
+type header struct {
+	ConnectionID  uint64
+	Action        Action
+	TransactionID int32
+}
+
+// connectRequest is the very first packet a client sends: just the magic
+// protocol ID and a transaction ID to return an initial connection ID.
+type connectRequest struct {
+	TransactionID int32
+}
+
+func parseConnectRequest(b []byte) (*connectRequest, error) {
+	if len(b) < connectRequestLen {
+		return nil, errMalformedPacket
+	}
+	if int64(binary.BigEndian.Uint64(b[0:8])) != protocolID {
+		return nil, errBadProtocolID
+	}
+	if Action(binary.BigEndian.Uint32(b[8:12])) != ActionConnect {
+		return nil, errUnknownAction
+	}
+	return &connectRequest{
+		TransactionID: int32(binary.BigEndian.Uint32(b[12:16])),
+	}, nil
+}
+
+func marshalConnectResponse(transactionID int32, connID uint64) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint32(b[0:4], uint32(ActionConnect))
+	binary.BigEndian.PutUint32(b[4:8], uint32(transactionID))
+	binary.BigEndian.PutUint64(b[8:16], connID)
+	return b
+}
+
+// announceRequest is a client's request to join or update its state in a
+// swarm, authenticated by a previously issued connection ID.
+type announceRequest struct {
+	ConnectionID  uint64
+	TransactionID int32
+	InfoHash      [infoHashLen]byte
+	PeerID        [peerIDLen]byte
+	Downloaded    int64
+	Left          int64
+	Uploaded      int64
+	Event         Event
+	IP            uint32
+	Key           uint32
+	NumWant       int32
+	Port          uint16
+
+	// Passkey identifies the announcing user on a private tracker. It is
+	// empty unless the client appended passkeyLen bytes after the
+	// standard announce body.
+	Passkey string
+}
+
+func parseAnnounceRequest(b []byte) (*announceRequest, error) {
+	if len(b) < announceRequestLen {
+		return nil, errMalformedPacket
+	}
+
+	req := &announceRequest{
+		ConnectionID:  binary.BigEndian.Uint64(b[0:8]),
+		TransactionID: int32(binary.BigEndian.Uint32(b[12:16])),
+		Downloaded:    int64(binary.BigEndian.Uint64(b[56:64])),
+		Left:          int64(binary.BigEndian.Uint64(b[64:72])),
+		Uploaded:      int64(binary.BigEndian.Uint64(b[72:80])),
+		Event:         Event(binary.BigEndian.Uint32(b[80:84])),
+		IP:            binary.BigEndian.Uint32(b[84:88]),
+		Key:           binary.BigEndian.Uint32(b[88:92]),
+		NumWant:       int32(binary.BigEndian.Uint32(b[92:96])),
+		Port:          binary.BigEndian.Uint16(b[96:98]),
+	}
+	copy(req.InfoHash[:], b[16:36])
+	copy(req.PeerID[:], b[36:56])
+
+	if Action(binary.BigEndian.Uint32(b[8:12])) != ActionAnnounce {
+		return nil, errUnknownAction
+	}
+
+	if len(b) >= announceRequestLen+passkeyLen {
+		req.Passkey = string(b[announceRequestLen : announceRequestLen+passkeyLen])
+	}
+
+	return req, nil
+}
+
+// marshalAnnounceResponse writes the fixed header followed by the compact
+// peer list in peers, copied as is: 6 bytes (4-byte IPv4 address + 2-byte
+// port) per IPv4 peer, or 18 bytes (16-byte address + port) per IPv6 peer.
+func marshalAnnounceResponse(transactionID int32, interval, leechers, seeders int32, peers []byte) []byte {
+	b := make([]byte, 20+len(peers))
+	binary.BigEndian.PutUint32(b[0:4], uint32(ActionAnnounce))
+	binary.BigEndian.PutUint32(b[4:8], uint32(transactionID))
+	binary.BigEndian.PutUint32(b[8:12], uint32(interval))
+	binary.BigEndian.PutUint32(b[12:16], uint32(leechers))
+	binary.BigEndian.PutUint32(b[16:20], uint32(seeders))
+	copy(b[20:], peers)
+	return b
+}
+
+// scrapeRequest carries between one and maxScrapeInfoHashes info_hashes to
+// report swarm statistics for.
+type scrapeRequest struct {
+	ConnectionID  uint64
+	TransactionID int32
+	InfoHashes    [][infoHashLen]byte
+}
+
+func parseScrapeRequest(b []byte) (*scrapeRequest, error) {
+	if len(b) < scrapeRequestLen || (len(b)-scrapeRequestLen)%infoHashLen != 0 {
+		return nil, errMalformedPacket
+	}
+	if Action(binary.BigEndian.Uint32(b[8:12])) != ActionScrape {
+		return nil, errUnknownAction
+	}
+
+	n := (len(b) - scrapeRequestLen) / infoHashLen
+	if n == 0 {
+		return nil, errMalformedPacket
+	}
+	if n > maxScrapeInfoHashes {
+		return nil, errTooManyInfoHashes
+	}
+
+	req := &scrapeRequest{
+		ConnectionID:  binary.BigEndian.Uint64(b[0:8]),
+		TransactionID: int32(binary.BigEndian.Uint32(b[12:16])),
+		InfoHashes:    make([][infoHashLen]byte, n),
+	}
+	for i := 0; i < n; i++ {
+		copy(req.InfoHashes[i][:], b[scrapeRequestLen+i*infoHashLen:scrapeRequestLen+(i+1)*infoHashLen])
+	}
+	return req, nil
+}
+
+// scrapeStats are the per-torrent counts reported by a scrape response.
+type scrapeStats struct {
+	Seeders   int32
+	Completed int32
+	Leechers  int32
+}
+
+func marshalScrapeResponse(transactionID int32, stats []scrapeStats) []byte {
+	b := make([]byte, 8+12*len(stats))
+	binary.BigEndian.PutUint32(b[0:4], uint32(ActionScrape))
+	binary.BigEndian.PutUint32(b[4:8], uint32(transactionID))
+	for i, s := range stats {
+		off := 8 + i*12
+		binary.BigEndian.PutUint32(b[off:off+4], uint32(s.Seeders))
+		binary.BigEndian.PutUint32(b[off+4:off+8], uint32(s.Completed))
+		binary.BigEndian.PutUint32(b[off+8:off+12], uint32(s.Leechers))
+	}
+	return b
+}
+
+func marshalErrorResponse(transactionID int32, message string) []byte {
+	b := make([]byte, 8+len(message))
+	binary.BigEndian.PutUint32(b[0:4], uint32(ActionError))
+	binary.BigEndian.PutUint32(b[4:8], uint32(transactionID))
+	copy(b[8:], message)
+	return b
+}
+
+// peekAction returns the action field shared by every request after the
+// connect request (bytes 8:12), used to dispatch an incoming packet before
+// fully parsing it.
+func peekAction(b []byte) (Action, error) {
+	if len(b) < 12 {
+		return 0, errMalformedPacket
+	}
+	return Action(binary.BigEndian.Uint32(b[8:12])), nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package udp
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestParseConnectRequest(t *testing.T) {
+	b := make([]byte, connectRequestLen)
+	binary.BigEndian.PutUint64(b[0:8], uint64(protocolID))
+	binary.BigEndian.PutUint32(b[8:12], uint32(ActionConnect))
+	binary.BigEndian.PutUint32(b[12:16], 1234)
+
+	req, err := parseConnectRequest(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.TransactionID != 1234 {
+		t.Errorf("TransactionID = %d, want 1234", req.TransactionID)
+	}
+}
+
+func TestParseConnectRequestBadProtocolID(t *testing.T) {
+	b := make([]byte, connectRequestLen)
+	binary.BigEndian.PutUint64(b[0:8], 0)
+	binary.BigEndian.PutUint32(b[8:12], uint32(ActionConnect))
+
+	if _, err := parseConnectRequest(b); err != errBadProtocolID {
+		t.Errorf("err = %v, want errBadProtocolID", err)
+	}
+}
+
+func TestConnectResponseRoundTrip(t *testing.T) {
+	b := marshalConnectResponse(1234, 0xdeadbeefcafebabe)
+
+	if action := Action(binary.BigEndian.Uint32(b[0:4])); action != ActionConnect {
+		t.Errorf("action = %v, want ActionConnect", action)
+	}
+	if txID := int32(binary.BigEndian.Uint32(b[4:8])); txID != 1234 {
+		t.Errorf("TransactionID = %d, want 1234", txID)
+	}
+	if connID := binary.BigEndian.Uint64(b[8:16]); connID != 0xdeadbeefcafebabe {
+		t.Errorf("connID = %x, want deadbeefcafebabe", connID)
+	}
+}
+
+func TestParseAnnounceRequest(t *testing.T) {
+	b := make([]byte, announceRequestLen)
+	binary.BigEndian.PutUint64(b[0:8], 42)
+	binary.BigEndian.PutUint32(b[8:12], uint32(ActionAnnounce))
+	binary.BigEndian.PutUint32(b[12:16], 99)
+	copy(b[16:36], []byte("01234567890123456789"))
+	copy(b[36:56], []byte("abcdefghijklmnopqrst"))
+	binary.BigEndian.PutUint64(b[56:64], 100)
+	binary.BigEndian.PutUint64(b[64:72], 200)
+	binary.BigEndian.PutUint64(b[72:80], 300)
+	binary.BigEndian.PutUint32(b[92:96], 50)
+	binary.BigEndian.PutUint16(b[96:98], 6889)
+
+	req, err := parseAnnounceRequest(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.ConnectionID != 42 || req.TransactionID != 99 {
+		t.Errorf("header = %+v, want ConnectionID 42, TransactionID 99", req)
+	}
+	if string(req.InfoHash[:]) != "01234567890123456789" {
+		t.Errorf("InfoHash = %q", req.InfoHash)
+	}
+	if req.Downloaded != 100 || req.Left != 200 || req.Uploaded != 300 {
+		t.Errorf("counters = %+v", req)
+	}
+	if req.NumWant != 50 || req.Port != 6889 {
+		t.Errorf("NumWant/Port = %d/%d, want 50/6889", req.NumWant, req.Port)
+	}
+	if req.Passkey != "" {
+		t.Errorf("Passkey = %q, want empty for a body with no trailing bytes", req.Passkey)
+	}
+}
+
+func TestParseAnnounceRequestWithPasskey(t *testing.T) {
+	b := make([]byte, announceRequestLen+passkeyLen)
+	binary.BigEndian.PutUint64(b[0:8], 42)
+	binary.BigEndian.PutUint32(b[8:12], uint32(ActionAnnounce))
+	binary.BigEndian.PutUint32(b[12:16], 99)
+	copy(b[16:36], []byte("01234567890123456789"))
+	copy(b[36:56], []byte("abcdefghijklmnopqrst"))
+	copy(b[announceRequestLen:], []byte("thisisa20bytepasskey"))
+
+	req, err := parseAnnounceRequest(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Passkey != "thisisa20bytepasskey" {
+		t.Errorf("Passkey = %q, want %q", req.Passkey, "thisisa20bytepasskey")
+	}
+}
+
+func TestParseAnnounceRequestTooShort(t *testing.T) {
+	if _, err := parseAnnounceRequest(make([]byte, announceRequestLen-1)); err != errMalformedPacket {
+		t.Errorf("err = %v, want errMalformedPacket", err)
+	}
+}
+
+func TestParseScrapeRequestTooManyInfoHashes(t *testing.T) {
+	b := make([]byte, scrapeRequestLen+infoHashLen*(maxScrapeInfoHashes+1))
+	binary.BigEndian.PutUint32(b[8:12], uint32(ActionScrape))
+
+	if _, err := parseScrapeRequest(b); err != errTooManyInfoHashes {
+		t.Errorf("err = %v, want errTooManyInfoHashes", err)
+	}
+}
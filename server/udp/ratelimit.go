@@ -0,0 +1,55 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package udp
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a simple per-source-IP request counter that resets once a
+// second, used to cap the rate of connect and announce requests accepted
+// from a single address so the tracker can't be used as a UDP reflection
+// amplifier.
+type rateLimiter struct {
+	max int
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newRateLimiter(max int) *rateLimiter {
+	rl := &rateLimiter{
+		max:    max,
+		counts: make(map[string]int),
+	}
+	go rl.resetLoop()
+	return rl
+}
+
+func (rl *rateLimiter) resetLoop() {
+	for range time.Tick(time.Second) {
+		rl.mu.Lock()
+		rl.counts = make(map[string]int)
+		rl.mu.Unlock()
+	}
+}
+
+// Allow reports whether another request from addr should be accepted this
+// second, incrementing its count as a side effect.
+func (rl *rateLimiter) Allow(addr string) bool {
+	if rl.max <= 0 {
+		return true
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.counts[addr] >= rl.max {
+		return false
+	}
+	rl.counts[addr]++
+	return true
+}
@@ -0,0 +1,281 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package udp implements a BitTorrent tracker server speaking the UDP
+// tracker protocol described in BEP 15: http://bittorrent.org/beps/bep_0015.html
+//
+// Unlike the HTTP tracker, every exchange begins with a connect request
+// that trades a client-chosen transaction ID for a connection ID. That
+// connection ID must accompany any subsequent announce or scrape request,
+// which lets the tracker discard unsolicited announces without doing any
+// storage work for them.
+package udp
+
+import (
+	"log"
+	"net"
+
+	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/stats"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/tracker"
+	"github.com/chihaya/chihaya/storage/tracker/redis"
+)
+
+// Server is a BitTorrent UDP tracker server.
+type Server struct {
+	cfg     *config.UDPConfig
+	private bool
+	pool    *redis.Pool
+
+	prefix string
+
+	connectLimiter  *rateLimiter
+	announceLimiter *rateLimiter
+}
+
+// New creates a Server that will read and write peer state through pool,
+// using prefix to namespace its keys just like the HTTP tracker's storage
+// layer. When private is true, announces are rejected unless they carry a
+// known user passkey and a whitelisted client, as enforced by
+// tracker.ValidateAnnounce.
+func New(cfg *config.UDPConfig, private bool, pool *redis.Pool, prefix string) *Server {
+	return &Server{
+		cfg:             cfg,
+		private:         private,
+		pool:            pool,
+		prefix:          prefix,
+		connectLimiter:  newRateLimiter(cfg.MaxConnectRate),
+		announceLimiter: newRateLimiter(cfg.MaxAnnounceRate),
+	}
+}
+
+// ListenAndServe binds to the server's configured address and serves UDP
+// tracker requests until an unrecoverable socket error occurs.
+func (s *Server) ListenAndServe() error {
+	addr, err := net.ResolveUDPAddr("udp", s.cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 2048)
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		go s.handlePacket(conn, remote, packet)
+	}
+}
+
+func (s *Server) handlePacket(conn *net.UDPConn, remote *net.UDPAddr, packet []byte) {
+	action, err := peekAction(packet)
+	if err != nil {
+		return
+	}
+
+	switch action {
+	case ActionConnect:
+		s.handleConnect(conn, remote, packet)
+	case ActionAnnounce:
+		s.handleAnnounce(conn, remote, packet)
+	case ActionScrape:
+		s.handleScrape(conn, remote, packet)
+	}
+}
+
+func (s *Server) reply(conn *net.UDPConn, remote *net.UDPAddr, b []byte) {
+	if _, err := conn.WriteToUDP(b, remote); err != nil {
+		log.Println("udp: failed to write response:", err)
+	}
+}
+
+func (s *Server) handleConnect(conn *net.UDPConn, remote *net.UDPAddr, packet []byte) {
+	if !s.connectLimiter.Allow(remote.IP.String()) {
+		return
+	}
+
+	req, err := parseConnectRequest(packet)
+	if err != nil {
+		return
+	}
+
+	connID := newConnectionID()
+
+	rc := s.pool.Get()
+	defer rc.Close()
+	if err := rc.PutConnectionID(connID, remote.String(), s.cfg.ConnectionIDTTL.Duration, s.prefix); err != nil {
+		log.Println("udp: failed to record connection id:", err)
+		return
+	}
+
+	s.reply(conn, remote, marshalConnectResponse(req.TransactionID, connID))
+}
+
+// handleAnnounce validates the connection ID handed back by the client
+// before doing any storage work, so that an attacker spoofing the victim's
+// source address without having completed a connect handshake gets
+// silently dropped rather than triggering a (larger) response.
+func (s *Server) handleAnnounce(conn *net.UDPConn, remote *net.UDPAddr, packet []byte) {
+	req, err := parseAnnounceRequest(packet)
+	if err != nil {
+		return
+	}
+	stats.Announces.Inc()
+
+	rc := s.pool.Get()
+	defer rc.Close()
+
+	valid, err := rc.ValidConnectionID(req.ConnectionID, remote.String(), s.prefix)
+	if err != nil {
+		log.Println("udp: failed to validate connection id:", err)
+		return
+	}
+	if !valid {
+		return
+	}
+
+	if !s.announceLimiter.Allow(remote.IP.String()) {
+		s.reply(conn, remote, marshalErrorResponse(req.TransactionID, "rate limited"))
+		return
+	}
+
+	user, err := tracker.ValidateAnnounce(rc, s.private, req.Passkey, string(req.PeerID[:]))
+	if err == tracker.ErrUnknownUser || err == tracker.ErrUnapprovedClient {
+		s.reply(conn, remote, marshalErrorResponse(req.TransactionID, err.Error()))
+		return
+	}
+	if err != nil {
+		log.Println("udp: failed to validate announce:", err)
+		return
+	}
+
+	infohash := string(req.InfoHash[:])
+	torrentID, ok, err := rc.FindTorrentID(infohash, s.prefix)
+	if err != nil {
+		log.Println("udp: failed to look up torrent:", err)
+		return
+	}
+	if !ok {
+		// CreateTorrentIfMissing claims infohash via SETNX, so a second
+		// concurrent first-announce for it resolves to the same
+		// winning torrentID rather than orphaning this one's peer
+		// under an ID nothing will ever look up again.
+		torrentID, err = rc.CreateTorrentIfMissing(&storage.Torrent{
+			ID:       newConnectionID(),
+			Infohash: infohash,
+			Active:   true,
+			Seeders:  map[string]storage.Peer{},
+			Leechers: map[string]storage.Peer{},
+		}, s.prefix)
+		if err != nil {
+			log.Println("udp: failed to create torrent:", err)
+			return
+		}
+	}
+
+	numWant := int(req.NumWant)
+	if numWant <= 0 || numWant > 50 {
+		numWant = 50
+	}
+
+	peer := &storage.Peer{
+		ID:         string(req.PeerID[:]),
+		TorrentID:  torrentID,
+		IP:         remote.IP,
+		Port:       uint64(req.Port),
+		Uploaded:   uint64(req.Uploaded),
+		Downloaded: uint64(req.Downloaded),
+		Left:       uint64(req.Left),
+	}
+	// passkey is only threaded into Announce once ValidateAnnounce has
+	// vouched for it; forwarding the raw, unauthenticated req.Passkey
+	// would let any client mint an unbounded number of
+	// prefix+"user:"+<garbage> hash keys in Redis by varying it on every
+	// announce.
+	var passkey string
+	if user != nil {
+		peer.UserID = user.ID
+		passkey = req.Passkey
+	}
+
+	// rc.Announce performs the peer upsert, swarm membership update and
+	// compact-peer rendering as a single atomic EVALSHA, closing the race
+	// TestInvalidPeers simulates between separate setPeer/getPeers round
+	// trips (see the comment on announceScript).
+	seeders, leechers, compact, err := rc.Announce(peer, passkey, eventName(req.Event), numWant, s.prefix)
+	if err != nil {
+		log.Println("udp: failed to announce:", err)
+		return
+	}
+
+	s.reply(conn, remote, marshalAnnounceResponse(
+		req.TransactionID,
+		int32(s.cfg.AnnounceInterval.Duration.Seconds()),
+		int32(leechers),
+		int32(seeders),
+		compact,
+	))
+}
+
+func (s *Server) handleScrape(conn *net.UDPConn, remote *net.UDPAddr, packet []byte) {
+	req, err := parseScrapeRequest(packet)
+	if err != nil {
+		return
+	}
+	stats.Scrapes.Inc()
+
+	rc := s.pool.Get()
+	defer rc.Close()
+
+	valid, err := rc.ValidConnectionID(req.ConnectionID, remote.String(), s.prefix)
+	if err != nil {
+		log.Println("udp: failed to validate connection id:", err)
+		return
+	}
+	if !valid {
+		s.reply(conn, remote, marshalErrorResponse(req.TransactionID, "connection id expired"))
+		return
+	}
+
+	stats := make([]scrapeStats, len(req.InfoHashes))
+	for i, ih := range req.InfoHashes {
+		torrentID, ok, err := rc.FindTorrentID(string(ih[:]), s.prefix)
+		if err != nil {
+			log.Println("udp: failed to look up torrent:", err)
+			return
+		}
+		if !ok {
+			continue
+		}
+
+		seeders, leechers, err := rc.SwarmCounts(torrentID, s.prefix)
+		if err != nil {
+			log.Println("udp: failed to load swarm counts:", err)
+			return
+		}
+		stats[i] = scrapeStats{Seeders: int32(seeders), Leechers: int32(leechers)}
+	}
+
+	s.reply(conn, remote, marshalScrapeResponse(req.TransactionID, stats))
+}
+
+// eventName maps a parsed BEP 15 announce event to the event string
+// announceScript understands; only "completed" is treated specially; the
+// remaining events are inferred by the script from the peer's Left field.
+func eventName(e Event) string {
+	if e == EventCompleted {
+		return "completed"
+	}
+	return ""
+}
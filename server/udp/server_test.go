@@ -0,0 +1,238 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package udp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/storage/tracker/redis"
+)
+
+func panicOnErr(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+// createTestServer returns a Server backed by a live Redis instance (see
+// storage/tracker/redis/redis_test.go for the same TESTCONFIGPATH
+// convention), with rate limiting disabled unless maxAnnounceRate is set.
+func createTestServer(t *testing.T, private bool, maxAnnounceRate int) *Server {
+	testConfig, err := config.Open(os.Getenv("TESTCONFIGPATH"))
+	panicOnErr(err)
+
+	pool, err := redis.New(&testConfig.Cache)
+	panicOnErr(err)
+
+	udpCfg := testConfig.UDP
+	udpCfg.MaxAnnounceRate = maxAnnounceRate
+	udpCfg.MaxConnectRate = 0
+
+	return New(&udpCfg, private, pool, testConfig.Cache.Prefix)
+}
+
+func createTestInfohash() [infoHashLen]byte {
+	var b [infoHashLen]byte
+	n, err := io.ReadFull(rand.Reader, b[:])
+	if n != len(b) || err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func createTestPeerID() [peerIDLen]byte {
+	var b [peerIDLen]byte
+	n, err := io.ReadFull(rand.Reader, b[:])
+	if n != len(b) || err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// udpPipe is a pair of loopback UDP sockets wired together so a handler can
+// be driven with its real conn.WriteToUDP reply path instead of a mock.
+type udpPipe struct {
+	client *net.UDPConn
+	server *net.UDPConn
+}
+
+func newUDPPipe(t *testing.T) *udpPipe {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &udpPipe{client: client, server: server}
+}
+
+func (p *udpPipe) Close() {
+	p.client.Close()
+	p.server.Close()
+}
+
+func (p *udpPipe) clientAddr() *net.UDPAddr {
+	return p.client.LocalAddr().(*net.UDPAddr)
+}
+
+func (p *udpPipe) readClientReply(t *testing.T) []byte {
+	p.client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	n, err := p.client.Read(buf)
+	if err != nil {
+		t.Fatal("no reply received:", err)
+	}
+	return buf[:n]
+}
+
+func marshalAnnounceRequest(connID uint64, transactionID int32, infohash [infoHashLen]byte, peerID [peerIDLen]byte, left int64, passkey string) []byte {
+	b := make([]byte, announceRequestLen+len(passkey))
+	binary.BigEndian.PutUint64(b[0:8], connID)
+	binary.BigEndian.PutUint32(b[8:12], uint32(ActionAnnounce))
+	binary.BigEndian.PutUint32(b[12:16], uint32(transactionID))
+	copy(b[16:36], infohash[:])
+	copy(b[36:56], peerID[:])
+	binary.BigEndian.PutUint64(b[64:72], uint64(left))
+	binary.BigEndian.PutUint32(b[92:96], 50)
+	binary.BigEndian.PutUint16(b[96:98], 6889)
+	copy(b[announceRequestLen:], passkey)
+	return b
+}
+
+// connect drives a real connect handshake over pipe and returns the
+// connection ID the server handed back.
+func connect(t *testing.T, s *Server, pipe *udpPipe) uint64 {
+	b := make([]byte, connectRequestLen)
+	binary.BigEndian.PutUint64(b[0:8], uint64(protocolID))
+	binary.BigEndian.PutUint32(b[8:12], uint32(ActionConnect))
+	binary.BigEndian.PutUint32(b[12:16], 1)
+
+	s.handleConnect(pipe.server, pipe.clientAddr(), b)
+	reply := pipe.readClientReply(t)
+	if len(reply) < 16 {
+		t.Fatalf("connect reply too short: %d bytes", len(reply))
+	}
+	return binary.BigEndian.Uint64(reply[8:16])
+}
+
+// TestHandleAnnounceRoundTrip exercises a full connect+announce exchange
+// against a fresh infohash and checks the announce response reports the
+// client as the swarm's only seeder.
+func TestHandleAnnounceRoundTrip(t *testing.T) {
+	s := createTestServer(t, false, 0)
+	pipe := newUDPPipe(t)
+	defer pipe.Close()
+
+	connID := connect(t, s, pipe)
+	infohash := createTestInfohash()
+	peerID := createTestPeerID()
+	req := marshalAnnounceRequest(connID, 2, infohash, peerID, 0, "")
+
+	s.handleAnnounce(pipe.server, pipe.clientAddr(), req)
+	reply := pipe.readClientReply(t)
+	if len(reply) < 20 {
+		t.Fatalf("announce reply too short: %d bytes", len(reply))
+	}
+	if action := Action(binary.BigEndian.Uint32(reply[0:4])); action != ActionAnnounce {
+		t.Fatalf("action = %d, want ActionAnnounce (reply: %v)", action, reply)
+	}
+	seeders := int32(binary.BigEndian.Uint32(reply[16:20]))
+	if seeders != 1 {
+		t.Errorf("seeders = %d, want 1", seeders)
+	}
+}
+
+// TestHandleAnnounceRateLimited checks that a second announce from the same
+// source address within the same second is dropped with an error response.
+func TestHandleAnnounceRateLimited(t *testing.T) {
+	s := createTestServer(t, false, 1)
+	pipe := newUDPPipe(t)
+	defer pipe.Close()
+
+	connID := connect(t, s, pipe)
+	infohash := createTestInfohash()
+
+	s.handleAnnounce(pipe.server, pipe.clientAddr(), marshalAnnounceRequest(connID, 2, infohash, createTestPeerID(), 0, ""))
+	pipe.readClientReply(t)
+
+	s.handleAnnounce(pipe.server, pipe.clientAddr(), marshalAnnounceRequest(connID, 3, infohash, createTestPeerID(), 0, ""))
+	reply := pipe.readClientReply(t)
+	if action := Action(binary.BigEndian.Uint32(reply[0:4])); action != ActionError {
+		t.Fatalf("action = %d, want ActionError for rate-limited announce", action)
+	}
+}
+
+// TestHandleAnnouncePrivateRejectsUnknownPasskey checks that a private
+// tracker rejects an announce whose passkey doesn't belong to any known
+// user, rather than threading it into storage.
+func TestHandleAnnouncePrivateRejectsUnknownPasskey(t *testing.T) {
+	s := createTestServer(t, true, 0)
+	pipe := newUDPPipe(t)
+	defer pipe.Close()
+
+	connID := connect(t, s, pipe)
+	infohash := createTestInfohash()
+	req := marshalAnnounceRequest(connID, 2, infohash, createTestPeerID(), 0, "thisisa20bytepasskey")
+
+	s.handleAnnounce(pipe.server, pipe.clientAddr(), req)
+	reply := pipe.readClientReply(t)
+	if action := Action(binary.BigEndian.Uint32(reply[0:4])); action != ActionError {
+		t.Fatalf("action = %d, want ActionError for unknown passkey", action)
+	}
+}
+
+// TestHandleAnnounceConcurrentFirstAnnounce regression-tests the race fixed
+// by CreateTorrentIfMissing: two concurrent first announces for the same
+// never-seen infohash must resolve to a single winning torrent, rather than
+// each minting their own ID and orphaning the loser's peer.
+func TestHandleAnnounceConcurrentFirstAnnounce(t *testing.T) {
+	s := createTestServer(t, false, 0)
+	infohash := createTestInfohash()
+
+	const n = 8
+	done := make(chan uint64, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			pipe := newUDPPipe(t)
+			defer pipe.Close()
+
+			connID := connect(t, s, pipe)
+			req := marshalAnnounceRequest(connID, int32(i), infohash, createTestPeerID(), 0, "")
+			s.handleAnnounce(pipe.server, pipe.clientAddr(), req)
+			reply := pipe.readClientReply(t)
+
+			rc := s.pool.Get()
+			defer rc.Close()
+			torrentID, ok, err := rc.FindTorrentID(string(infohash[:]), s.prefix)
+			panicOnErr(err)
+			if !ok {
+				t.Error("torrent not found after announce")
+			}
+			if len(reply) < 20 {
+				t.Error("announce reply too short")
+			}
+			done <- torrentID
+		}(i)
+	}
+
+	var ids []uint64
+	for i := 0; i < n; i++ {
+		ids = append(ids, <-done)
+	}
+	for _, id := range ids[1:] {
+		if id != ids[0] {
+			t.Fatalf("torrent IDs diverged across concurrent first announces: %v", ids)
+		}
+	}
+}
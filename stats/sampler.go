@@ -0,0 +1,63 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package stats
+
+import (
+	"log"
+	"time"
+)
+
+// Scanner is implemented by a storage backend that can report the
+// aggregate counts a Sampler periodically publishes as the Torrents,
+// Seeders, and Leechers gauges.
+type Scanner interface {
+	ScanStats() (torrents, seeders, leechers int, err error)
+}
+
+// Sampler periodically refreshes the tracker-domain gauges by scanning a
+// Scanner's backing store, since those totals - unlike a single announce's
+// redis calls - are too expensive to recompute on every request.
+type Sampler struct {
+	scanner  Scanner
+	interval time.Duration
+	done     chan struct{}
+}
+
+// NewSampler creates a Sampler that calls scanner.ScanStats every interval.
+func NewSampler(scanner Scanner, interval time.Duration) *Sampler {
+	return &Sampler{
+		scanner:  scanner,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+}
+
+// Run samples on a ticker until Stop is called. It blocks, so callers
+// typically start it with `go sampler.Run()`.
+func (s *Sampler) Run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			torrents, seeders, leechers, err := s.scanner.ScanStats()
+			if err != nil {
+				log.Println("stats: failed to sample tracker stats:", err)
+				continue
+			}
+			Torrents.Set(float64(torrents))
+			Seeders.Set(float64(seeders))
+			Leechers.Set(float64(leechers))
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Stop ends a running Sampler's Run loop.
+func (s *Sampler) Stop() {
+	close(s.done)
+}
@@ -0,0 +1,36 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package stats
+
+import (
+	"expvar"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/chihaya/chihaya/config"
+)
+
+// Server serves the /metrics endpoint (and, if configured, /debug/vars)
+// described by a config.StatsConfig.
+type Server struct {
+	cfg *config.StatsConfig
+}
+
+// New creates a Server from the given configuration.
+func New(cfg *config.StatsConfig) *Server {
+	return &Server{cfg: cfg}
+}
+
+// ListenAndServe binds to the server's configured address and serves HTTP
+// requests until an unrecoverable socket error occurs.
+func (s *Server) ListenAndServe() error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	if s.cfg.Expvar {
+		mux.Handle("/debug/vars", expvar.Handler())
+	}
+	return http.ListenAndServe(s.cfg.ListenAddr, mux)
+}
@@ -0,0 +1,114 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package stats instruments the tracker's storage layer and exposes the
+// resulting counters over HTTP for Prometheus (and, optionally, expvar) to
+// scrape.
+package stats
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// RedisOpDuration records how long each addPeers/getPeers/removePeers
+	// call takes, labeled by operation name, so operators can alert on
+	// rising redis latency.
+	RedisOpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "chihaya",
+		Subsystem: "redis",
+		Name:      "op_duration_seconds",
+		Help:      "Time taken by redis storage operations.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"op"})
+
+	// RedisErrors counts failed redis calls, labeled by operation name.
+	RedisErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chihaya",
+		Subsystem: "redis",
+		Name:      "errors_total",
+		Help:      "Redis storage operations that returned an error.",
+	}, []string{"op"})
+
+	// PeerDisappeared counts peers whose hash had vanished by the time
+	// getPeers tried to read it after finding it in the swarm set - the
+	// race TestInvalidPeers simulates.
+	PeerDisappeared = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "chihaya",
+		Subsystem: "redis",
+		Name:      "peer_disappeared_total",
+		Help:      "Peers whose hash was gone by the time getPeers tried to read it.",
+	})
+
+	// PoolActiveConns and PoolIdleConns mirror redis.Pool.Stats, so a
+	// saturated pool shows up before it starts queuing callers.
+	PoolActiveConns = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "chihaya",
+		Subsystem: "redis",
+		Name:      "pool_active_connections",
+		Help:      "Connections currently checked out of the redis pool.",
+	})
+	PoolIdleConns = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "chihaya",
+		Subsystem: "redis",
+		Name:      "pool_idle_connections",
+		Help:      "Idle connections currently held by the redis pool.",
+	})
+
+	// Torrents, Seeders, and Leechers are tracker-domain gauges, refreshed
+	// periodically by a Sampler scanning the storage backend.
+	Torrents = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "chihaya",
+		Subsystem: "tracker",
+		Name:      "torrents",
+		Help:      "Total torrents currently tracked.",
+	})
+	Seeders = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "chihaya",
+		Subsystem: "tracker",
+		Name:      "seeders",
+		Help:      "Total seeders across all tracked torrents.",
+	})
+	Leechers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "chihaya",
+		Subsystem: "tracker",
+		Name:      "leechers",
+		Help:      "Total leechers across all tracked torrents.",
+	})
+
+	// Announces and Scrapes count UDP tracker requests handled, so
+	// operators can derive announces/sec and scrapes/sec from a rate().
+	Announces = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "chihaya",
+		Subsystem: "tracker",
+		Name:      "announces_total",
+		Help:      "Announce requests handled.",
+	})
+	Scrapes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "chihaya",
+		Subsystem: "tracker",
+		Name:      "scrapes_total",
+		Help:      "Scrape requests handled.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		RedisOpDuration, RedisErrors, PeerDisappeared,
+		PoolActiveConns, PoolIdleConns,
+		Torrents, Seeders, Leechers,
+		Announces, Scrapes,
+	)
+}
+
+// Timer starts timing a redis operation named op. Call the returned func
+// when the operation completes to record its duration in RedisOpDuration.
+func Timer(op string) func() {
+	start := time.Now()
+	return func() {
+		RedisOpDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	}
+}
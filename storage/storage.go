@@ -0,0 +1,60 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package storage defines the data types shared by every storage backend
+// that a Chihaya tracker can be configured to use.
+package storage
+
+import (
+	"fmt"
+	"net"
+)
+
+// Peer is a participant in a torrent swarm, either seeding or leeching.
+// IP may hold either a 4-byte (IPv4) or 16-byte (IPv6) address.
+type Peer struct {
+	ID           string
+	UserID       uint64
+	TorrentID    uint64
+	IP           net.IP
+	Port         uint64
+	Uploaded     uint64
+	Downloaded   uint64
+	Left         uint64
+	LastAnnounce int64
+}
+
+// User is a registered tracker account, identified by a unique passkey and
+// carrying the upload/download ratio multipliers applied to its peers.
+type User struct {
+	ID             uint64
+	Passkey        string
+	UpMultiplier   float64
+	DownMultiplier float64
+	Slots          uint64
+	SlotsUsed      uint64
+	Snatches       uint64
+	Uploaded       uint64
+	Downloaded     uint64
+}
+
+// Torrent is a single swarm, made up of the seeders and leechers currently
+// announcing for it.
+type Torrent struct {
+	ID             uint64
+	Infohash       string
+	Active         bool
+	Seeders        map[string]Peer
+	Leechers       map[string]Peer
+	Snatches       uint64
+	UpMultiplier   float64
+	DownMultiplier float64
+	LastAction     int64
+}
+
+// PeerMapKey returns the key used to index p within a Torrent's Seeders or
+// Leechers map.
+func PeerMapKey(p *Peer) string {
+	return fmt.Sprintf("%d-%s", p.UserID, p.ID)
+}
@@ -0,0 +1,199 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package memory implements an in-process tracker.Driver backed by plain
+// Go maps, suitable for single-node deployments and for tests that don't
+// want to depend on a running Redis instance.
+package memory
+
+import (
+	"sync"
+
+	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/tracker"
+)
+
+func init() {
+	tracker.Register("memory", driver{})
+}
+
+type driver struct{}
+
+func (d driver) New(conf *config.Config) (tracker.Conn, error) {
+	return &Conn{
+		torrents:        make(map[string]*storage.Torrent),
+		users:           make(map[string]*storage.User),
+		whitelistClient: make(map[string]bool),
+	}, nil
+}
+
+// Conn is an in-memory tracker.Conn. The zero value is not usable; create
+// one with New (via tracker.Open with a Config.StorageDriver of "memory").
+type Conn struct {
+	mu sync.RWMutex
+
+	torrents        map[string]*storage.Torrent // keyed by infohash
+	users           map[string]*storage.User    // keyed by passkey
+	whitelistClient map[string]bool             // keyed by peer ID prefix
+}
+
+// Close implements tracker.Conn. It is a no-op: there is no connection to
+// release.
+func (c *Conn) Close() error {
+	return nil
+}
+
+func copyPeerMap(m map[string]storage.Peer) map[string]storage.Peer {
+	cp := make(map[string]storage.Peer, len(m))
+	for k, v := range m {
+		cp[k] = v
+	}
+	return cp
+}
+
+// FindTorrent implements tracker.Conn.
+func (c *Conn) FindTorrent(infohash string) (*storage.Torrent, bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	t, ok := c.torrents[infohash]
+	if !ok {
+		return nil, false, nil
+	}
+
+	cp := *t
+	cp.Seeders = copyPeerMap(t.Seeders)
+	cp.Leechers = copyPeerMap(t.Leechers)
+	return &cp, true, nil
+}
+
+// PutTorrent implements tracker.Conn.
+func (c *Conn) PutTorrent(t *storage.Torrent) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cp := *t
+	cp.Seeders = copyPeerMap(t.Seeders)
+	cp.Leechers = copyPeerMap(t.Leechers)
+	c.torrents[t.Infohash] = &cp
+	return nil
+}
+
+func (c *Conn) findTorrentByID(torrentID uint64) *storage.Torrent {
+	for _, t := range c.torrents {
+		if t.ID == torrentID {
+			return t
+		}
+	}
+	return nil
+}
+
+// AddPeers implements tracker.Conn.
+func (c *Conn) AddPeers(torrentID uint64, peers map[string]storage.Peer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := c.findTorrentByID(torrentID)
+	if t == nil {
+		return nil
+	}
+
+	for key, peer := range peers {
+		if peer.Left == 0 {
+			t.Seeders[key] = peer
+		} else {
+			t.Leechers[key] = peer
+		}
+	}
+	return nil
+}
+
+// RemovePeers implements tracker.Conn.
+func (c *Conn) RemovePeers(torrentID uint64, peers map[string]storage.Peer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := c.findTorrentByID(torrentID)
+	for key := range peers {
+		if t != nil {
+			delete(t.Seeders, key)
+			delete(t.Leechers, key)
+		}
+		delete(peers, key)
+	}
+	return nil
+}
+
+// FindUser implements tracker.Conn.
+func (c *Conn) FindUser(passkey string) (*storage.User, bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	u, ok := c.users[passkey]
+	if !ok {
+		return nil, false, nil
+	}
+	cp := *u
+	return &cp, true, nil
+}
+
+// PutUser implements tracker.Conn.
+func (c *Conn) PutUser(u *storage.User) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cp := *u
+	c.users[u.Passkey] = &cp
+	return nil
+}
+
+// DeleteUser implements tracker.Conn.
+func (c *Conn) DeleteUser(passkey string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.users, passkey)
+	return nil
+}
+
+// RecordSnatch implements tracker.Conn.
+func (c *Conn) RecordSnatch(u *storage.User, t *storage.Torrent) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if stored, ok := c.users[u.Passkey]; ok {
+		stored.Snatches++
+	}
+	if stored := c.findTorrentByID(t.ID); stored != nil {
+		stored.Snatches++
+	}
+	return nil
+}
+
+// ClientWhitelisted implements tracker.Conn.
+func (c *Conn) ClientWhitelisted(peerIDPrefix string) (bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.whitelistClient[peerIDPrefix], nil
+}
+
+// PutClient implements tracker.Conn.
+func (c *Conn) PutClient(peerIDPrefix string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.whitelistClient[peerIDPrefix] = true
+	return nil
+}
+
+// DeleteClient implements tracker.Conn.
+func (c *Conn) DeleteClient(peerIDPrefix string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.whitelistClient, peerIDPrefix)
+	return nil
+}
@@ -0,0 +1,19 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package memory
+
+import (
+	"testing"
+
+	"github.com/chihaya/chihaya/storage/tracker/storagetest"
+)
+
+func TestConn(t *testing.T) {
+	conn, err := (driver{}).New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storagetest.RunSuite(t, conn)
+}
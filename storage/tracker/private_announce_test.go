@@ -0,0 +1,88 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker_test
+
+import (
+	"testing"
+
+	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/tracker"
+	_ "github.com/chihaya/chihaya/storage/tracker/memory"
+)
+
+// seedPrivateTracker registers three users and one whitelisted client
+// against a fresh in-memory Conn, returning the users for the caller to
+// announce as.
+func seedPrivateTracker(t *testing.T) (tracker.Conn, []*storage.User, string) {
+	t.Helper()
+
+	conn, err := tracker.Open(&config.Config{StorageDriver: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := make([]*storage.User, 3)
+	for i := range users {
+		users[i] = &storage.User{Passkey: "passkey" + string(rune('a'+i))}
+		if err := conn.PutUser(users[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const whitelistedClient = "-TT0001-"
+	if err := conn.PutClient(whitelistedClient); err != nil {
+		t.Fatal(err)
+	}
+
+	return conn, users, whitelistedClient
+}
+
+func TestValidateAnnounceAcceptsKnownUserAndClient(t *testing.T) {
+	conn, users, client := seedPrivateTracker(t)
+	defer conn.Close()
+
+	peerID := client + "deadbeefdeadbeef12"
+	user, err := tracker.ValidateAnnounce(conn, true, users[1].Passkey, peerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Passkey != users[1].Passkey {
+		t.Errorf("ValidateAnnounce returned user %q, want %q", user.Passkey, users[1].Passkey)
+	}
+}
+
+func TestValidateAnnounceRejectsUnknownPasskey(t *testing.T) {
+	conn, _, client := seedPrivateTracker(t)
+	defer conn.Close()
+
+	peerID := client + "deadbeefdeadbeef12"
+	if _, err := tracker.ValidateAnnounce(conn, true, "not-a-real-passkey", peerID); err != tracker.ErrUnknownUser {
+		t.Errorf("err = %v, want ErrUnknownUser", err)
+	}
+}
+
+func TestValidateAnnounceRejectsUnapprovedClient(t *testing.T) {
+	conn, users, _ := seedPrivateTracker(t)
+	defer conn.Close()
+
+	peerID := "-XX0001-deadbeefdeadbeef12"
+	if _, err := tracker.ValidateAnnounce(conn, true, users[0].Passkey, peerID); err != tracker.ErrUnapprovedClient {
+		t.Errorf("err = %v, want ErrUnapprovedClient", err)
+	}
+}
+
+func TestValidateAnnounceSkippedWhenNotPrivate(t *testing.T) {
+	conn, _, _ := seedPrivateTracker(t)
+	defer conn.Close()
+
+	user, err := tracker.ValidateAnnounce(conn, false, "whatever", "whatever")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != nil {
+		t.Errorf("ValidateAnnounce returned a user %+v in non-private mode, want nil", user)
+	}
+}
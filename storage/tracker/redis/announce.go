@@ -0,0 +1,161 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package redis
+
+import (
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/chihaya/chihaya/storage"
+)
+
+// announceScript atomically performs the storage side effects of a single
+// announce: upserting the peer hash, moving the peer between the seeder and
+// leecher sets, crediting the user's ratio counters for the delta since its
+// last announce, adjusting the user's slots_used count for the delta in
+// whether this peer is leeching, bumping the torrent's snatch count on a
+// "completed" event, and rendering a compact-peer blob of the response.
+// Doing this as one script closes the races that addPeers/getPeers leave
+// open when called as separate round trips (see the comment on
+// createTorrent and the scenario TestInvalidPeers simulates).
+//
+// KEYS: 1 = peer hash key, 2 = seeder set key, 3 = leecher set key,
+// 4 = user hash key, 5 = torrent hash key.
+// ARGV: 1 = peer id, 2 = user id, 3 = torrent id, 4 = encoded ip,
+// 5 = port, 6 = uploaded, 7 = downloaded, 8 = left, 9 = last announce,
+// 10 = event, 11 = numwant, 12 = set member (unprefixed peer hash key),
+// 13 = key prefix.
+const announceScript = `
+local peerHashKey, seederSetKey, leecherSetKey, userHashKey, torrentHashKey = KEYS[1], KEYS[2], KEYS[3], KEYS[4], KEYS[5]
+local peerID, userID, torrentID, ip, port, uploaded, downloaded, left, lastAnnounce, event, numwant, member, prefix =
+	ARGV[1], ARGV[2], ARGV[3], ARGV[4], ARGV[5], tonumber(ARGV[6]), tonumber(ARGV[7]), tonumber(ARGV[8]), ARGV[9], ARGV[10], tonumber(ARGV[11]), ARGV[12], ARGV[13]
+
+local prevUploaded = tonumber(redis.call('HGET', peerHashKey, 'uploaded')) or 0
+local prevDownloaded = tonumber(redis.call('HGET', peerHashKey, 'downloaded')) or 0
+local prevLeft = tonumber(redis.call('HGET', peerHashKey, 'left'))
+
+redis.call('HMSET', peerHashKey,
+	'id', peerID, 'user_id', userID, 'torrent_id', torrentID,
+	'ip', ip, 'port', port, 'uploaded', uploaded, 'downloaded', downloaded,
+	'left', left, 'last_announce', lastAnnounce)
+
+if left == 0 then
+	redis.call('SADD', seederSetKey, member)
+	redis.call('SREM', leecherSetKey, member)
+else
+	redis.call('SADD', leecherSetKey, member)
+	redis.call('SREM', seederSetKey, member)
+end
+
+-- slots_used tracks how many torrents this user is currently leeching, so
+-- ValidateAnnounce's caller can cap it against the user's Slots; the only
+-- way to keep it from drifting is to derive the delta from this peer's
+-- own previous 'left' value inside the same atomic script that just wrote
+-- the new one.
+local wasLeeching = prevLeft ~= nil and prevLeft > 0
+local isLeeching = left > 0
+if isLeeching and not wasLeeching then
+	redis.call('HINCRBY', userHashKey, 'slots_used', 1)
+elseif wasLeeching and not isLeeching then
+	redis.call('HINCRBY', userHashKey, 'slots_used', -1)
+end
+
+local upMultiplier = tonumber(redis.call('HGET', userHashKey, 'up_multiplier')) or 1
+local downMultiplier = tonumber(redis.call('HGET', userHashKey, 'down_multiplier')) or 1
+local uploadedDelta = uploaded - prevUploaded
+local downloadedDelta = downloaded - prevDownloaded
+if uploadedDelta > 0 then
+	redis.call('HINCRBYFLOAT', userHashKey, 'uploaded', uploadedDelta * upMultiplier)
+end
+if downloadedDelta > 0 then
+	redis.call('HINCRBYFLOAT', userHashKey, 'downloaded', downloadedDelta * downMultiplier)
+end
+
+if event == 'completed' then
+	redis.call('HINCRBY', torrentHashKey, 'snatches', 1)
+end
+
+local seeders = redis.call('SCARD', seederSetKey)
+local leechers = redis.call('SCARD', leecherSetKey)
+
+local family = string.byte(ip, 1)
+local members = redis.call('SMEMBERS', seederSetKey)
+for _, m in ipairs(redis.call('SMEMBERS', leecherSetKey)) do
+	table.insert(members, m)
+end
+
+local compact = {}
+local count = 0
+for _, m in ipairs(members) do
+	if count >= numwant then
+		break
+	end
+	if m ~= member then
+		local storedIP = redis.call('HGET', prefix .. m, 'ip')
+		local storedPort = tonumber(redis.call('HGET', prefix .. m, 'port'))
+		if storedIP and string.byte(storedIP, 1) == family then
+			local addr = string.sub(storedIP, 2)
+			table.insert(compact, addr .. string.char(math.floor(storedPort / 256) % 256, storedPort % 256))
+			count = count + 1
+		end
+	end
+end
+
+return {seeders, leechers, table.concat(compact)}
+`
+
+// loadAnnounceScript registers announceScript with the Redis instance conn
+// is connected to and returns its SHA1, suitable for later EVALSHA calls.
+func loadAnnounceScript(conn redis.Conn) (string, error) {
+	return redis.String(conn.Do("SCRIPT", "LOAD", announceScript))
+}
+
+// announce runs announceScript via EVALSHA, reloading it with SCRIPT LOAD
+// and retrying once if the instance doesn't recognize the hash (e.g. after
+// a Redis restart that dropped its script cache).
+func (c *Conn) announce(peer *storage.Peer, passkey, event string, numWant int, prefix string) (seeders, leechers int, compact []byte, err error) {
+	member := getPeerHashKey(peer)
+	args := []interface{}{
+		5, // numkeys
+		prefix + member,
+		getSwarmSetKey(peer.TorrentID, prefix, true),
+		getSwarmSetKey(peer.TorrentID, prefix, false),
+		prefix + "user:" + passkey,
+		fmt.Sprintf("%storrent:%d", prefix, peer.TorrentID),
+		peer.ID, peer.UserID, peer.TorrentID, encodePeerIP(peer.IP), peer.Port,
+		peer.Uploaded, peer.Downloaded, peer.Left, peer.LastAnnounce,
+		event, numWant, member, prefix,
+	}
+
+	reply, err := redis.Values(c.Do("EVALSHA", append([]interface{}{c.announceSHA}, args...)...))
+	if err != nil && isNoScriptErr(err) {
+		if c.announceSHA, err = loadAnnounceScript(c.Conn); err != nil {
+			return 0, 0, nil, err
+		}
+		reply, err = redis.Values(c.Do("EVALSHA", append([]interface{}{c.announceSHA}, args...)...))
+	}
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	if _, err := redis.Scan(reply, &seeders, &leechers, &compact); err != nil {
+		return 0, 0, nil, err
+	}
+	return seeders, leechers, compact, nil
+}
+
+// Announce is the exported form of announce, for use outside the package
+// (e.g. by the UDP tracker server).
+func (c *Conn) Announce(peer *storage.Peer, passkey, event string, numWant int, prefix string) (seeders, leechers int, compact []byte, err error) {
+	return c.announce(peer, passkey, event, numWant, prefix)
+}
+
+// isNoScriptErr reports whether err is the "NOSCRIPT" error Redis returns
+// from EVALSHA when it doesn't recognize the given SHA1.
+func isNoScriptErr(err error) bool {
+	s := err.Error()
+	return len(s) >= 8 && s[:8] == "NOSCRIPT"
+}
@@ -0,0 +1,98 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package redis
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/chihaya/chihaya/storage"
+)
+
+// TestConcurrentAnnounce runs N concurrent Announce calls for distinct
+// peers of the same user and torrent, each over its own connection, and
+// checks that the user's ratio counters end up as the exact sum of every
+// peer's contribution. The separate addPeers/getPeers round trips used
+// elsewhere in this package can't make that guarantee (see the comment on
+// createTorrent and the race TestInvalidPeers simulates); announceScript's
+// single EVALSHA round trip can.
+func TestConcurrentAnnounce(t *testing.T) {
+	const n = 20
+
+	user := createTestUser()
+	user.UpMultiplier = 1.0
+	user.DownMultiplier = 1.0
+	setupConn := createTestRedisConn()
+	panicOnErr(setupConn.PutUser(user))
+
+	torrentID := createTestTorrentID()
+
+	var wantUploaded, wantDownloaded uint64
+	peers := make([]*storage.Peer, n)
+	for i := range peers {
+		peers[i] = createTestPeer(user.ID, torrentID)
+		wantUploaded += peers[i].Uploaded
+		wantDownloaded += peers[i].Downloaded
+	}
+
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer *storage.Peer) {
+			defer wg.Done()
+			conn := createTestRedisConn()
+			defer conn.Close()
+			if _, _, _, err := conn.Announce(peer, user.Passkey, "", 0, "test:"); err != nil {
+				panic(err)
+			}
+		}(peer)
+	}
+	wg.Wait()
+
+	got, ok, err := setupConn.FindUser(user.Passkey)
+	panicOnErr(err)
+	if !ok {
+		t.Fatal("user not found after concurrent announces")
+	}
+	if got.Uploaded != wantUploaded {
+		t.Errorf("Uploaded = %d, want %d", got.Uploaded, wantUploaded)
+	}
+	if got.Downloaded != wantDownloaded {
+		t.Errorf("Downloaded = %d, want %d", got.Downloaded, wantDownloaded)
+	}
+
+	_, leechers, err := setupConn.SwarmCounts(torrentID, "test:")
+	panicOnErr(err)
+	if leechers != n {
+		t.Errorf("leechers = %d, want %d", leechers, n)
+	}
+}
+
+// TestAnnounceSnatch checks that an event of "completed" bumps the
+// torrent's snatch count exactly once.
+func TestAnnounceSnatch(t *testing.T) {
+	testConn := createTestRedisConn()
+	user := createTestUser()
+	panicOnErr(testConn.PutUser(user))
+
+	torrent := createTestTorrent()
+	torrent.Seeders = map[string]storage.Peer{}
+	torrent.Leechers = map[string]storage.Peer{}
+	panicOnErr(testConn.createTorrent(torrent, "test:"))
+
+	peer := createTestPeer(user.ID, torrent.ID)
+	if _, _, _, err := testConn.Announce(peer, user.Passkey, "completed", 0, "test:"); err != nil {
+		t.Fatal(err)
+	}
+
+	found, ok, err := testConn.FindTorrent(torrent.Infohash)
+	panicOnErr(err)
+	if !ok {
+		t.Fatal("torrent not found after Announce")
+	}
+	if found.Snatches != torrent.Snatches+1 {
+		t.Errorf("Snatches = %d, want %d", found.Snatches, torrent.Snatches+1)
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package redis
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func getConnectionIDKey(connID uint64) string {
+	return fmt.Sprintf("udp:conn:%d", connID)
+}
+
+// PutConnectionID records that connID was handed out to the client at addr,
+// expiring it after ttl so that a pool of tracker processes sharing this
+// Redis instance can validate connection IDs issued by any of them.
+func (c *Conn) PutConnectionID(connID uint64, addr string, ttl time.Duration, prefix string) error {
+	_, err := c.Do("SETEX", prefix+getConnectionIDKey(connID), int(ttl.Seconds()), addr)
+	return err
+}
+
+// ValidConnectionID reports whether connID was previously issued to addr
+// and has not yet expired.
+func (c *Conn) ValidConnectionID(connID uint64, addr string, prefix string) (bool, error) {
+	stored, err := redis.String(c.Do("GET", prefix+getConnectionIDKey(connID)))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return stored == addr, nil
+}
@@ -0,0 +1,272 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package redis
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/tracker"
+)
+
+func init() {
+	tracker.Register("redis", &driver{pools: make(map[string]*Pool)})
+}
+
+// driver caches one *Pool per distinct cache config, so that - unlike
+// database/sql, where Open is cheap and DB pools the underlying
+// connections - repeated tracker.Open calls for the same config don't
+// each pay for a fresh dial and SCRIPT LOAD.
+type driver struct {
+	mu    sync.Mutex
+	pools map[string]*Pool
+}
+
+// New returns a *Conn checked out of the shared *Pool for conf.Cache,
+// creating that pool on first use, satisfying tracker.Driver.
+func (d *driver) New(conf *config.Config) (tracker.Conn, error) {
+	key := poolKey(&conf.Cache)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	pool, ok := d.pools[key]
+	if !ok {
+		var err error
+		pool, err = New(&conf.Cache)
+		if err != nil {
+			return nil, err
+		}
+		d.pools[key] = pool
+	}
+
+	return pool.Get(), nil
+}
+
+// poolKey identifies the redis instance and keyspace a CacheConfig points
+// at, so two configs that only differ in e.g. MaxIdleConns still share a
+// pool.
+func poolKey(conf *config.CacheConfig) string {
+	return conf.Network + " " + conf.Addr + " " + conf.Prefix
+}
+
+// FindTorrent implements tracker.Conn.
+func (c *Conn) FindTorrent(infohash string) (*storage.Torrent, bool, error) {
+	prefix := c.conf.Prefix
+
+	torrentID, ok, err := c.FindTorrentID(infohash, prefix)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	reply, err := redis.Values(c.Do("HGETALL", fmt.Sprintf("%storrent:%d", prefix, torrentID)))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(reply) == 0 {
+		return nil, false, nil
+	}
+
+	t, err := torrentFromHash(reply)
+	if err != nil {
+		return nil, false, err
+	}
+
+	peers, err := c.getPeers(torrentID, prefix)
+	if err != nil {
+		return nil, false, err
+	}
+
+	t.Seeders = make(map[string]storage.Peer)
+	t.Leechers = make(map[string]storage.Peer)
+	for key, peer := range peers {
+		if peer.Left == 0 {
+			t.Seeders[key] = peer
+		} else {
+			t.Leechers[key] = peer
+		}
+	}
+
+	return t, true, nil
+}
+
+// PutTorrent implements tracker.Conn.
+func (c *Conn) PutTorrent(t *storage.Torrent) error {
+	return c.createTorrent(t, c.conf.Prefix)
+}
+
+// AddPeers implements tracker.Conn. torrentID is unused beyond identifying
+// the call site: each peer already carries its own TorrentID.
+func (c *Conn) AddPeers(torrentID uint64, peers map[string]storage.Peer) error {
+	return c.addPeers(peers, c.conf.Prefix)
+}
+
+// RemovePeers implements tracker.Conn.
+func (c *Conn) RemovePeers(torrentID uint64, peers map[string]storage.Peer) error {
+	return c.removePeers(torrentID, peers, c.conf.Prefix)
+}
+
+// FindUser implements tracker.Conn.
+func (c *Conn) FindUser(passkey string) (*storage.User, bool, error) {
+	reply, err := redis.Values(c.Do("HGETALL", c.conf.Prefix+"user:"+passkey))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(reply) == 0 {
+		return nil, false, nil
+	}
+
+	u, err := userFromHash(reply)
+	if err != nil {
+		return nil, false, err
+	}
+	return u, true, nil
+}
+
+// PutUser implements tracker.Conn.
+func (c *Conn) PutUser(u *storage.User) error {
+	_, err := c.Do("HMSET", c.conf.Prefix+"user:"+u.Passkey,
+		"id", u.ID,
+		"passkey", u.Passkey,
+		"up_multiplier", u.UpMultiplier,
+		"down_multiplier", u.DownMultiplier,
+		"slots", u.Slots,
+		"slots_used", u.SlotsUsed,
+		"snatches", u.Snatches,
+		"uploaded", u.Uploaded,
+		"downloaded", u.Downloaded,
+	)
+	return err
+}
+
+// DeleteUser implements tracker.Conn.
+func (c *Conn) DeleteUser(passkey string) error {
+	_, err := c.Do("DEL", c.conf.Prefix+"user:"+passkey)
+	return err
+}
+
+// RecordSnatch implements tracker.Conn, incrementing both the user's and
+// the torrent's snatch counters.
+func (c *Conn) RecordSnatch(u *storage.User, t *storage.Torrent) error {
+	c.Send("MULTI")
+	c.Send("HINCRBY", c.conf.Prefix+"user:"+u.Passkey, "snatches", 1)
+	c.Send("HINCRBY", fmt.Sprintf("%storrent:%d", c.conf.Prefix, t.ID), "snatches", 1)
+	_, err := c.Do("EXEC")
+	return err
+}
+
+// ClientWhitelisted implements tracker.Conn.
+func (c *Conn) ClientWhitelisted(peerIDPrefix string) (bool, error) {
+	return redis.Bool(c.Do("SISMEMBER", c.conf.Prefix+"clients", peerIDPrefix))
+}
+
+// PutClient implements tracker.Conn.
+func (c *Conn) PutClient(peerIDPrefix string) error {
+	_, err := c.Do("SADD", c.conf.Prefix+"clients", peerIDPrefix)
+	return err
+}
+
+// DeleteClient implements tracker.Conn.
+func (c *Conn) DeleteClient(peerIDPrefix string) error {
+	_, err := c.Do("SREM", c.conf.Prefix+"clients", peerIDPrefix)
+	return err
+}
+
+func torrentFromHash(reply []interface{}) (*storage.Torrent, error) {
+	m, err := redis.StringMap(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := strconv.ParseUint(m["id"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	snatches, err := strconv.ParseUint(m["snatches"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	upMultiplier, err := strconv.ParseFloat(m["up_multiplier"], 64)
+	if err != nil {
+		return nil, err
+	}
+	downMultiplier, err := strconv.ParseFloat(m["down_multiplier"], 64)
+	if err != nil {
+		return nil, err
+	}
+	lastAction, err := strconv.ParseInt(m["last_action"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &storage.Torrent{
+		ID:             id,
+		Infohash:       m["infohash"],
+		Active:         m["active"] == "1",
+		Snatches:       snatches,
+		UpMultiplier:   upMultiplier,
+		DownMultiplier: downMultiplier,
+		LastAction:     lastAction,
+	}, nil
+}
+
+func userFromHash(reply []interface{}) (*storage.User, error) {
+	m, err := redis.StringMap(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := strconv.ParseUint(m["id"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	upMultiplier, err := strconv.ParseFloat(m["up_multiplier"], 64)
+	if err != nil {
+		return nil, err
+	}
+	downMultiplier, err := strconv.ParseFloat(m["down_multiplier"], 64)
+	if err != nil {
+		return nil, err
+	}
+	slots, err := strconv.ParseUint(m["slots"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	slotsUsed, err := strconv.ParseUint(m["slots_used"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	snatches, err := strconv.ParseUint(m["snatches"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	// Stored as a float because the announce script credits these with
+	// HINCRBYFLOAT (the user's ratio multiplier is itself fractional).
+	uploaded, err := strconv.ParseFloat(m["uploaded"], 64)
+	if err != nil {
+		return nil, err
+	}
+	downloaded, err := strconv.ParseFloat(m["downloaded"], 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &storage.User{
+		ID:             id,
+		Passkey:        m["passkey"],
+		UpMultiplier:   upMultiplier,
+		DownMultiplier: downMultiplier,
+		Slots:          slots,
+		SlotsUsed:      slotsUsed,
+		Snatches:       snatches,
+		Uploaded:       uint64(uploaded),
+		Downloaded:     uint64(downloaded),
+	}, nil
+}
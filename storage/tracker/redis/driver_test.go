@@ -0,0 +1,15 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package redis
+
+import (
+	"testing"
+
+	"github.com/chihaya/chihaya/storage/tracker/storagetest"
+)
+
+func TestConn(t *testing.T) {
+	storagetest.RunSuite(t, createTestRedisConn())
+}
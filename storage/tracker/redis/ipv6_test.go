@@ -0,0 +1,103 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package redis
+
+import (
+	"net"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/chihaya/chihaya/storage"
+)
+
+func createTestPeerWithIP(userID, torrentID uint64, ip net.IP) *storage.Peer {
+	peer := createTestPeer(userID, torrentID)
+	peer.IP = ip
+	return peer
+}
+
+// TestDualStackPeers puts an IPv4 peer and an IPv6 peer in the same
+// torrent and checks that each family round-trips through addPeers
+// and getPeers unchanged.
+func TestDualStackPeers(t *testing.T) {
+	testConn := createTestRedisConn()
+	testTorrentID := createTestTorrentID()
+
+	v4Peer := createTestPeerWithIP(createTestUserID(), testTorrentID, net.ParseIP("127.0.0.1"))
+	v6Peer := createTestPeerWithIP(createTestUserID(), testTorrentID, net.ParseIP("2001:db8::1"))
+	testPeers := map[string]storage.Peer{
+		storage.PeerMapKey(v4Peer): *v4Peer,
+		storage.PeerMapKey(v6Peer): *v6Peer,
+	}
+
+	panicOnErr(testConn.addPeers(testPeers, "test:"))
+	defer testConn.removePeers(testTorrentID, testPeers, "test:")
+
+	peerMap, err := testConn.getPeers(testTorrentID, "test:")
+	panicOnErr(err)
+
+	if len(peerMap) != 2 {
+		t.Fatalf("len(peerMap) = %d, want 2", len(peerMap))
+	}
+
+	var gotV4, gotV6 int
+	for _, p := range peerMap {
+		switch {
+		case p.IP.To4() != nil:
+			gotV4++
+		case p.IP.To16() != nil:
+			gotV6++
+		default:
+			t.Errorf("peer %+v has neither a v4 nor v6 address", p)
+		}
+	}
+	if gotV4 != 1 || gotV6 != 1 {
+		t.Errorf("v4/v6 peers = %d/%d, want 1/1", gotV4, gotV6)
+	}
+}
+
+// TestLegacyPeerIPMigration simulates a peer hash written before the "ip"
+// field was length-prefixed (a plain dotted-decimal string) and checks
+// that getPeers both reads it correctly and rewrites it in the new
+// format.
+func TestLegacyPeerIPMigration(t *testing.T) {
+	testConn := createTestRedisConn()
+	testTorrentID := createTestTorrentID()
+	peer := createTestPeer(createTestUserID(), testTorrentID)
+
+	hashKey := testConn.conf.Prefix + getPeerHashKey(peer)
+	_, err := testConn.Do("HMSET", hashKey,
+		"id", peer.ID,
+		"user_id", peer.UserID,
+		"torrent_id", peer.TorrentID,
+		"ip", peer.IP.String(), // legacy plain-string encoding
+		"port", peer.Port,
+		"uploaded", peer.Uploaded,
+		"downloaded", peer.Downloaded,
+		"left", peer.Left,
+		"last_announce", peer.LastAnnounce,
+	)
+	panicOnErr(err)
+	_, err = testConn.Do("SADD", getSwarmSetKey(testTorrentID, "test:", peer.Left == 0), getPeerHashKey(peer))
+	panicOnErr(err)
+
+	peerMap, err := testConn.getPeers(testTorrentID, "test:")
+	panicOnErr(err)
+
+	got, ok := peerMap[storage.PeerMapKey(peer)]
+	if !ok {
+		t.Fatal("legacy peer not found by getPeers")
+	}
+	if !got.IP.Equal(peer.IP) {
+		t.Errorf("IP = %v, want %v", got.IP, peer.IP)
+	}
+
+	reply, err := redis.Bytes(testConn.Do("HGET", hashKey, "ip"))
+	panicOnErr(err)
+	if len(reply) == 0 || reply[0] != 4 {
+		t.Errorf("ip field not migrated to length-prefixed format: %v", reply)
+	}
+}
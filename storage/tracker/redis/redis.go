@@ -0,0 +1,410 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package redis implements the storage interface for a Chihaya tracker
+// backed by a Redis pool.
+package redis
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/stats"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// Pool wraps a redigo connection pool configured from a config.CacheConfig.
+type Pool struct {
+	conf        *config.CacheConfig
+	pool        redis.Pool
+	announceSHA string
+}
+
+// Conn is a single connection checked out of a Pool.
+type Conn struct {
+	conf        *config.CacheConfig
+	done        bool
+	announceSHA string
+	redis.Conn
+}
+
+// New creates a new Pool from the given cache configuration, loading
+// announceScript into the instance's script cache so Conn.Announce can
+// invoke it with EVALSHA from the first call.
+func New(conf *config.CacheConfig) (*Pool, error) {
+	p := &Pool{
+		conf: conf,
+		pool: redis.Pool{
+			MaxIdle:      conf.MaxIdleConns,
+			IdleTimeout:  conf.IdleTimeout.Duration,
+			Dial:         makeDialFunc(conf),
+			TestOnBorrow: testOnBorrow,
+		},
+	}
+
+	conn := p.pool.Get()
+	defer conn.Close()
+	sha, err := loadAnnounceScript(conn)
+	if err != nil {
+		return nil, err
+	}
+	p.announceSHA = sha
+
+	return p, nil
+}
+
+// Get checks out a Conn from the pool.
+func (p *Pool) Get() *Conn {
+	p.updatePoolStats()
+	return &Conn{
+		conf:        p.conf,
+		announceSHA: p.announceSHA,
+		Conn:        p.pool.Get(),
+	}
+}
+
+// updatePoolStats refreshes stats.PoolActiveConns and stats.PoolIdleConns
+// from the underlying redigo pool, so a saturated pool shows up in metrics
+// before it starts queuing callers.
+func (p *Pool) updatePoolStats() {
+	s := p.pool.Stats()
+	stats.PoolActiveConns.Set(float64(s.ActiveCount))
+	stats.PoolIdleConns.Set(float64(s.IdleCount))
+}
+
+// Close marks the connection as done and returns it to the pool.
+func (c *Conn) Close() error {
+	c.done = true
+	return c.Conn.Close()
+}
+
+func makeDialFunc(conf *config.CacheConfig) func() (redis.Conn, error) {
+	return func() (redis.Conn, error) {
+		conn, err := redis.Dial(conf.Network, conf.Addr)
+		if err != nil {
+			return nil, err
+		}
+		if conf.Password != "" {
+			if _, err := conn.Do("AUTH", conf.Password); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return conn, nil
+	}
+}
+
+func testOnBorrow(c redis.Conn, t time.Time) error {
+	_, err := c.Do("PING")
+	return err
+}
+
+// getPeerHashKey returns the key of the hash holding peer's announce state,
+// relative to the configured prefix.
+func getPeerHashKey(peer *storage.Peer) string {
+	return fmt.Sprintf("peer:%d:%s", peer.TorrentID, peer.ID)
+}
+
+func getSwarmSetKey(torrentID uint64, prefix string, seeder bool) string {
+	kind := "leechers"
+	if seeder {
+		kind = "seeders"
+	}
+	return fmt.Sprintf("%storrent:%d:%s", prefix, torrentID, kind)
+}
+
+// createTorrent writes a torrent's metadata hash and seeds its seeder and
+// leecher sets. Like addPeers below, this is a multiple action command,
+// it's not internally atomic: a crash partway through can leave the
+// torrent hash written without all of its peer sets.
+func (c *Conn) createTorrent(t *storage.Torrent, prefix string) error {
+	torrentKey := fmt.Sprintf("%storrent:%d", prefix, t.ID)
+
+	c.Send("MULTI")
+	c.Send("HMSET", torrentKey,
+		"id", t.ID,
+		"infohash", t.Infohash,
+		"active", t.Active,
+		"snatches", t.Snatches,
+		"up_multiplier", t.UpMultiplier,
+		"down_multiplier", t.DownMultiplier,
+		"last_action", t.LastAction,
+	)
+	c.Send("SET", prefix+"infohash:"+t.Infohash, t.ID)
+	if _, err := c.Do("EXEC"); err != nil {
+		return err
+	}
+
+	if err := c.addPeers(t.Seeders, prefix); err != nil {
+		return err
+	}
+	return c.addPeers(t.Leechers, prefix)
+}
+
+// CreateTorrentIfMissing atomically claims t.Infohash for t.ID via SETNX
+// before writing t's metadata hash and peer sets, so two connections
+// racing the first announce for a never-seen infohash can't each mint
+// their own torrent ID and orphan the loser's swarm-set entries under an
+// ID the infohash key will never resolve to again. If another connection
+// has already claimed the infohash by the time this call runs, t is left
+// unwritten and the winning ID is returned instead.
+func (c *Conn) CreateTorrentIfMissing(t *storage.Torrent, prefix string) (torrentID uint64, err error) {
+	won, err := redis.Bool(c.Do("SETNX", prefix+"infohash:"+t.Infohash, t.ID))
+	if err != nil {
+		return 0, err
+	}
+	if !won {
+		return redis.Uint64(c.Do("GET", prefix+"infohash:"+t.Infohash))
+	}
+
+	torrentKey := fmt.Sprintf("%storrent:%d", prefix, t.ID)
+	if _, err := c.Do("HMSET", torrentKey,
+		"id", t.ID,
+		"infohash", t.Infohash,
+		"active", t.Active,
+		"snatches", t.Snatches,
+		"up_multiplier", t.UpMultiplier,
+		"down_multiplier", t.DownMultiplier,
+		"last_action", t.LastAction,
+	); err != nil {
+		return 0, err
+	}
+
+	if err := c.addPeers(t.Seeders, prefix); err != nil {
+		return 0, err
+	}
+	if err := c.addPeers(t.Leechers, prefix); err != nil {
+		return 0, err
+	}
+	return t.ID, nil
+}
+
+// addPeers writes peers to their individual hashes and indexes them into
+// the appropriate seeder/leecher set for their torrent.
+func (c *Conn) addPeers(peers map[string]storage.Peer, prefix string) error {
+	defer stats.Timer("addPeers")()
+
+	for _, peer := range peers {
+		p := peer
+		if err := c.setPeer(&p, prefix); err != nil {
+			stats.RedisErrors.WithLabelValues("addPeers").Inc()
+			return err
+		}
+	}
+	return nil
+}
+
+// setPeer writes a single peer's hash and adds it to its torrent's
+// seeder or leecher set, depending on whether it has anything left to
+// download.
+func (c *Conn) setPeer(peer *storage.Peer, prefix string) error {
+	hashKey := prefix + getPeerHashKey(peer)
+
+	c.Send("MULTI")
+	c.Send("HMSET", hashKey,
+		"id", peer.ID,
+		"user_id", peer.UserID,
+		"torrent_id", peer.TorrentID,
+		"ip", encodePeerIP(peer.IP),
+		"port", peer.Port,
+		"uploaded", peer.Uploaded,
+		"downloaded", peer.Downloaded,
+		"left", peer.Left,
+		"last_announce", peer.LastAnnounce,
+	)
+	c.Send("SADD", getSwarmSetKey(peer.TorrentID, prefix, peer.Left == 0), getPeerHashKey(peer))
+	_, err := c.Do("EXEC")
+	return err
+}
+
+// getPeers returns every peer currently registered for torrentID, reading
+// the seeder and leecher sets and then hydrating each member from its
+// hash. A peer whose hash has disappeared (e.g. expired or removed by
+// another tracker process) between the set read and the hash read is
+// silently skipped.
+func (c *Conn) getPeers(torrentID uint64, prefix string) (map[string]storage.Peer, error) {
+	defer stats.Timer("getPeers")()
+
+	peerMap := make(map[string]storage.Peer)
+
+	for _, seeder := range []bool{true, false} {
+		setKey := getSwarmSetKey(torrentID, prefix, seeder)
+		members, err := redis.Strings(c.Do("SMEMBERS", setKey))
+		if err != nil {
+			stats.RedisErrors.WithLabelValues("getPeers").Inc()
+			return nil, err
+		}
+
+		for _, member := range members {
+			hashKey := prefix + member
+			reply, err := redis.Values(c.Do("HGETALL", hashKey))
+			if err != nil {
+				stats.RedisErrors.WithLabelValues("getPeers").Inc()
+				return nil, err
+			}
+			if len(reply) == 0 {
+				// The hash is gone; the peer vanished between the set read
+				// and this read. Skip it rather than returning a zero peer.
+				stats.PeerDisappeared.Inc()
+				continue
+			}
+
+			peer, migrated, err := peerFromHash(reply)
+			if err != nil {
+				stats.RedisErrors.WithLabelValues("getPeers").Inc()
+				return nil, err
+			}
+			if migrated {
+				// The hash predates length-prefixed IP storage; rewrite it
+				// in the new format so future reads skip this step.
+				if _, err := c.Do("HSET", hashKey, "ip", encodePeerIP(peer.IP)); err != nil {
+					stats.RedisErrors.WithLabelValues("getPeers").Inc()
+					return nil, err
+				}
+			}
+			peerMap[storage.PeerMapKey(peer)] = *peer
+		}
+	}
+
+	return peerMap, nil
+}
+
+// encodePeerIP renders ip as a length-prefixed byte string: a single byte
+// giving the address length (4 or 16) followed by that many address
+// bytes, so the same "ip" hash field can hold either family.
+func encodePeerIP(ip net.IP) []byte {
+	addr := ip.To4()
+	if addr == nil {
+		addr = ip.To16()
+	}
+	return append([]byte{byte(len(addr))}, addr...)
+}
+
+// decodePeerIP parses the "ip" hash field written by encodePeerIP. For
+// compatibility with hashes written before peers carried length-prefixed
+// addresses, it also accepts a plain dotted-decimal IPv4 string and
+// reports that case via the second return value so the caller can
+// migrate the entry.
+func decodePeerIP(raw []byte) (ip net.IP, legacy bool, err error) {
+	if len(raw) > 0 && int(raw[0]) == len(raw)-1 && (raw[0] == 4 || raw[0] == 16) {
+		return net.IP(raw[1:]), false, nil
+	}
+
+	ip = net.ParseIP(string(raw))
+	if ip == nil {
+		return nil, false, fmt.Errorf("redis: invalid peer ip %q", raw)
+	}
+	return ip, true, nil
+}
+
+// FindTorrentID looks up the torrent ID registered for infohash, returning
+// false if no torrent has been created for it yet.
+func (c *Conn) FindTorrentID(infohash string, prefix string) (uint64, bool, error) {
+	id, err := redis.Uint64(c.Do("GET", prefix+"infohash:"+infohash))
+	if err == redis.ErrNil {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return id, true, nil
+}
+
+// SwarmCounts returns the number of seeders and leechers currently
+// registered for torrentID.
+func (c *Conn) SwarmCounts(torrentID uint64, prefix string) (seeders, leechers int, err error) {
+	seeders, err = redis.Int(c.Do("SCARD", getSwarmSetKey(torrentID, prefix, true)))
+	if err != nil {
+		return 0, 0, err
+	}
+	leechers, err = redis.Int(c.Do("SCARD", getSwarmSetKey(torrentID, prefix, false)))
+	if err != nil {
+		return 0, 0, err
+	}
+	return seeders, leechers, nil
+}
+
+// removePeers deletes each peer's hash and its entry in the corresponding
+// seeder/leecher set, then removes it from the provided map so callers can
+// confirm nothing was left behind.
+func (c *Conn) removePeers(torrentID uint64, peers map[string]storage.Peer, prefix string) error {
+	defer stats.Timer("removePeers")()
+
+	for key, peer := range peers {
+		p := peer
+		hashKey := prefix + getPeerHashKey(&p)
+		setKey := getSwarmSetKey(torrentID, prefix, p.Left == 0)
+
+		c.Send("MULTI")
+		c.Send("DEL", hashKey)
+		c.Send("SREM", setKey, getPeerHashKey(&p))
+		if _, err := c.Do("EXEC"); err != nil {
+			stats.RedisErrors.WithLabelValues("removePeers").Inc()
+			return err
+		}
+
+		delete(peers, key)
+	}
+	return nil
+}
+
+// peerFromHash parses a peer hash reply, also reporting whether the "ip"
+// field was stored in the legacy plain-string format and should be
+// migrated by the caller.
+func peerFromHash(reply []interface{}) (peer *storage.Peer, migrated bool, err error) {
+	m, err := redis.StringMap(reply, nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	torrentID, err := strconv.ParseUint(m["torrent_id"], 10, 64)
+	if err != nil {
+		return nil, false, err
+	}
+	userID, err := strconv.ParseUint(m["user_id"], 10, 64)
+	if err != nil {
+		return nil, false, err
+	}
+	port, err := strconv.ParseUint(m["port"], 10, 64)
+	if err != nil {
+		return nil, false, err
+	}
+	uploaded, err := strconv.ParseUint(m["uploaded"], 10, 64)
+	if err != nil {
+		return nil, false, err
+	}
+	downloaded, err := strconv.ParseUint(m["downloaded"], 10, 64)
+	if err != nil {
+		return nil, false, err
+	}
+	left, err := strconv.ParseUint(m["left"], 10, 64)
+	if err != nil {
+		return nil, false, err
+	}
+	lastAnnounce, err := strconv.ParseInt(m["last_announce"], 10, 64)
+	if err != nil {
+		return nil, false, err
+	}
+	ip, migrated, err := decodePeerIP([]byte(m["ip"]))
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &storage.Peer{
+		ID:           m["id"],
+		UserID:       userID,
+		TorrentID:    torrentID,
+		IP:           ip,
+		Port:         port,
+		Uploaded:     uploaded,
+		Downloaded:   downloaded,
+		Left:         left,
+		LastAnnounce: lastAnnounce,
+	}, migrated, nil
+}
@@ -8,12 +8,11 @@ import (
 	"crypto/rand"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"strconv"
 	"testing"
 
-	"github.com/garyburd/redigo/redis"
-
 	"github.com/chihaya/chihaya/config"
 	"github.com/chihaya/chihaya/storage"
 )
@@ -85,26 +84,13 @@ func panicOnErr(err error) {
 
 func createTestRedisConn() *Conn {
 	testConfig, err := config.Open(os.Getenv("TESTCONFIGPATH"))
-	conf := &testConfig.Cache
 	panicOnErr(err)
 
-	testPool := &Pool{
-		conf: conf,
-		pool: redis.Pool{
-			MaxIdle:      conf.MaxIdleConns,
-			IdleTimeout:  conf.IdleTimeout.Duration,
-			Dial:         makeDialFunc(conf),
-			TestOnBorrow: testOnBorrow,
-		},
-	}
-
-	newConn := &Conn{
-		conf: testPool.conf,
-		done: false,
-		Conn: testPool.pool.Get(),
-	}
+	testPool, err := New(&testConfig.Cache)
 	panicOnErr(err)
 
+	newConn := testPool.Get()
+
 	// Test connection before returning
 	_, err = newConn.Do("PING")
 	panicOnErr(err)
@@ -119,7 +105,7 @@ func createTestUser() *storage.User {
 func createTestPeer(userID uint64, torrentID uint64) *storage.Peer {
 
 	return &storage.Peer{ID: createTestPeerID(), UserID: userID, TorrentID: torrentID,
-		IP: "127.0.0.1", Port: 6889, Uploaded: 1024, Downloaded: 3000, Left: 4200, LastAnnounce: 11}
+		IP: net.ParseIP("127.0.0.1"), Port: 6889, Uploaded: 1024, Downloaded: 3000, Left: 4200, LastAnnounce: 11}
 }
 
 func createTestPeers(torrentID uint64, num int) map[string]storage.Peer {
@@ -0,0 +1,59 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package redis
+
+import (
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ScanStats implements stats.Scanner, tallying the number of torrents and
+// their total seeders/leechers by SCANning this connection's configured
+// prefix rather than tracking running counters that could drift from the
+// swarm sets they're meant to describe.
+func (c *Conn) ScanStats() (torrents, seeders, leechers int, err error) {
+	prefix := c.conf.Prefix
+	cursor := "0"
+	for {
+		reply, err := redis.Values(c.Do("SCAN", cursor, "MATCH", prefix+"torrent:*", "COUNT", 100))
+		if err != nil {
+			return 0, 0, 0, err
+		}
+
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return 0, 0, 0, err
+		}
+
+		for _, key := range keys {
+			// SCAN also matches this torrent's own seeder/leecher set
+			// keys; only the bare "prefix+torrent:<id>" key is the
+			// torrent hash itself.
+			if strings.HasSuffix(key, ":seeders") || strings.HasSuffix(key, ":leechers") {
+				continue
+			}
+			torrents++
+
+			torrentID := strings.TrimPrefix(key, prefix+"torrent:")
+			s, err := redis.Int(c.Do("SCARD", prefix+"torrent:"+torrentID+":seeders"))
+			if err != nil {
+				return 0, 0, 0, err
+			}
+			l, err := redis.Int(c.Do("SCARD", prefix+"torrent:"+torrentID+":leechers"))
+			if err != nil {
+				return 0, 0, 0, err
+			}
+			seeders += s
+			leechers += l
+		}
+
+		if cursor == "0" {
+			break
+		}
+	}
+
+	return torrents, seeders, leechers, nil
+}
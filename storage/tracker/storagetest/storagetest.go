@@ -0,0 +1,282 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package storagetest is a conformance test suite for tracker.Conn
+// implementations. A driver's own tests call RunSuite against a Conn of
+// its own construction to get the full peer-lifecycle test coverage that
+// every driver is expected to satisfy, without duplicating the test
+// bodies in each driver package.
+package storagetest
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/tracker"
+)
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+// randomTorrentID returns a torrent ID unlikely to collide with one a
+// driver's own tests picked, so this suite can run alongside them against
+// the same backing store without their fixtures colliding.
+func randomTorrentID() uint64 {
+	var b [8]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
+
+func newTestTorrent() *storage.Torrent {
+	return &storage.Torrent{
+		ID:       randomTorrentID(),
+		Infohash: randomString(20),
+		Active:   true,
+		Seeders:  make(map[string]storage.Peer),
+		Leechers: make(map[string]storage.Peer),
+	}
+}
+
+func newTestUser() *storage.User {
+	return &storage.User{
+		Passkey:        randomString(20),
+		UpMultiplier:   1.01,
+		DownMultiplier: 1.0,
+		Slots:          4,
+	}
+}
+
+func newTestPeer(torrentID uint64, left uint64) *storage.Peer {
+	return &storage.Peer{
+		ID:        randomString(20),
+		TorrentID: torrentID,
+		IP:        net.ParseIP("127.0.0.1"),
+		Port:      6889,
+		Left:      left,
+	}
+}
+
+func newTestPeer6(torrentID uint64, left uint64) *storage.Peer {
+	return &storage.Peer{
+		ID:        randomString(20),
+		TorrentID: torrentID,
+		IP:        net.ParseIP("2001:db8::1"),
+		Port:      6889,
+		Left:      left,
+	}
+}
+
+// RunSuite exercises conn against every operation a tracker.Conn is
+// expected to support. It is safe to call with a Conn returned by any
+// driver registered with the tracker package.
+func RunSuite(t *testing.T, conn tracker.Conn) {
+	t.Run("PutFindTorrent", func(t *testing.T) { testPutFindTorrent(t, conn) })
+	t.Run("AddRemovePeers", func(t *testing.T) { testAddRemovePeers(t, conn) })
+	t.Run("FindUserMissing", func(t *testing.T) { testFindUserMissing(t, conn) })
+	t.Run("PutFindDeleteUser", func(t *testing.T) { testPutFindDeleteUser(t, conn) })
+	t.Run("ClientWhitelistedMissing", func(t *testing.T) { testClientWhitelistedMissing(t, conn) })
+	t.Run("PutFindDeleteClient", func(t *testing.T) { testPutFindDeleteClient(t, conn) })
+	t.Run("DualStackPeers", func(t *testing.T) { testDualStackPeers(t, conn) })
+}
+
+func testPutFindTorrent(t *testing.T, conn tracker.Conn) {
+	torrent := newTestTorrent()
+
+	if err := conn.PutTorrent(torrent); err != nil {
+		t.Fatal(err)
+	}
+
+	found, ok, err := conn.FindTorrent(torrent.Infohash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("torrent not found after PutTorrent")
+	}
+	if found.ID != torrent.ID || found.Infohash != torrent.Infohash {
+		t.Errorf("FindTorrent = %+v, want ID %d Infohash %q", found, torrent.ID, torrent.Infohash)
+	}
+
+	if _, ok, err := conn.FindTorrent(randomString(20)); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Error("FindTorrent found a torrent that was never put")
+	}
+}
+
+func testAddRemovePeers(t *testing.T, conn tracker.Conn) {
+	torrent := newTestTorrent()
+	if err := conn.PutTorrent(torrent); err != nil {
+		t.Fatal(err)
+	}
+
+	seeder := newTestPeer(torrent.ID, 0)
+	leecher := newTestPeer(torrent.ID, 4200)
+	peers := map[string]storage.Peer{
+		storage.PeerMapKey(seeder):  *seeder,
+		storage.PeerMapKey(leecher): *leecher,
+	}
+
+	if err := conn.AddPeers(torrent.ID, peers); err != nil {
+		t.Fatal(err)
+	}
+
+	found, ok, err := conn.FindTorrent(torrent.Infohash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("torrent not found after AddPeers")
+	}
+	if len(found.Seeders) != 1 {
+		t.Errorf("len(Seeders) = %d, want 1", len(found.Seeders))
+	}
+	if len(found.Leechers) != 1 {
+		t.Errorf("len(Leechers) = %d, want 1", len(found.Leechers))
+	}
+
+	if err := conn.RemovePeers(torrent.ID, peers); err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 0 {
+		t.Errorf("RemovePeers left %d peers in the input map, want 0", len(peers))
+	}
+
+	found, ok, err = conn.FindTorrent(torrent.Infohash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("torrent not found after RemovePeers")
+	}
+	if len(found.Seeders) != 0 || len(found.Leechers) != 0 {
+		t.Errorf("Seeders/Leechers = %d/%d, want 0/0", len(found.Seeders), len(found.Leechers))
+	}
+}
+
+// testDualStackPeers puts an IPv4 peer and an IPv6 peer in the same
+// torrent and checks that each peer's address family survives a
+// round trip through the storage layer unchanged.
+func testDualStackPeers(t *testing.T, conn tracker.Conn) {
+	torrent := newTestTorrent()
+	if err := conn.PutTorrent(torrent); err != nil {
+		t.Fatal(err)
+	}
+
+	v4Peer := newTestPeer(torrent.ID, 0)
+	v6Peer := newTestPeer6(torrent.ID, 0)
+	peers := map[string]storage.Peer{
+		storage.PeerMapKey(v4Peer): *v4Peer,
+		storage.PeerMapKey(v6Peer): *v6Peer,
+	}
+
+	if err := conn.AddPeers(torrent.ID, peers); err != nil {
+		t.Fatal(err)
+	}
+
+	found, ok, err := conn.FindTorrent(torrent.Infohash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("torrent not found after AddPeers")
+	}
+
+	var gotV4, gotV6 int
+	for _, p := range found.Seeders {
+		if p.IP.To4() != nil {
+			gotV4++
+		} else {
+			gotV6++
+		}
+	}
+	if gotV4 != 1 || gotV6 != 1 {
+		t.Errorf("v4/v6 seeders = %d/%d, want 1/1", gotV4, gotV6)
+	}
+
+	if err := conn.RemovePeers(torrent.ID, peers); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testFindUserMissing(t *testing.T, conn tracker.Conn) {
+	_, ok, err := conn.FindUser(randomString(20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("FindUser found a user that was never put")
+	}
+}
+
+func testClientWhitelistedMissing(t *testing.T, conn tracker.Conn) {
+	ok, err := conn.ClientWhitelisted(randomString(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("ClientWhitelisted approved a client that was never whitelisted")
+	}
+}
+
+func testPutFindDeleteUser(t *testing.T, conn tracker.Conn) {
+	user := newTestUser()
+
+	if err := conn.PutUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	found, ok, err := conn.FindUser(user.Passkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("user not found after PutUser")
+	}
+	if found.Passkey != user.Passkey || found.Slots != user.Slots {
+		t.Errorf("FindUser = %+v, want Passkey %q Slots %d", found, user.Passkey, user.Slots)
+	}
+
+	if err := conn.DeleteUser(user.Passkey); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := conn.FindUser(user.Passkey); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Error("user still found after DeleteUser")
+	}
+}
+
+func testPutFindDeleteClient(t *testing.T, conn tracker.Conn) {
+	prefix := randomString(8)
+
+	if err := conn.PutClient(prefix); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := conn.ClientWhitelisted(prefix); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("client not whitelisted after PutClient")
+	}
+
+	if err := conn.DeleteClient(prefix); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := conn.ClientWhitelisted(prefix); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Error("client still whitelisted after DeleteClient")
+	}
+}
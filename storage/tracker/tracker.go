@@ -0,0 +1,105 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package tracker defines the interface a Chihaya storage backend must
+// implement, and a database/sql-style registry so the tracker can be
+// pointed at whichever backend a deployment configures without either
+// side importing the other directly.
+package tracker
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// Conn is a connection to a storage backend, carrying all of the
+// peer-lifecycle and accounting operations the tracker needs to serve an
+// announce or scrape.
+type Conn interface {
+	Close() error
+
+	// FindTorrent looks up the torrent registered under infohash. The
+	// second return value is false if no such torrent exists.
+	FindTorrent(infohash string) (*storage.Torrent, bool, error)
+
+	// PutTorrent creates or overwrites a torrent's metadata and peer
+	// sets.
+	PutTorrent(t *storage.Torrent) error
+
+	// AddPeers upserts peers into torrentID's seeder or leecher set,
+	// according to each peer's Left field.
+	AddPeers(torrentID uint64, peers map[string]storage.Peer) error
+
+	// RemovePeers deletes peers from torrentID's swarm.
+	RemovePeers(torrentID uint64, peers map[string]storage.Peer) error
+
+	// FindUser looks up the user registered under passkey. The second
+	// return value is false if no such user exists.
+	FindUser(passkey string) (*storage.User, bool, error)
+
+	// PutUser creates or overwrites the user registered under u.Passkey.
+	PutUser(u *storage.User) error
+
+	// DeleteUser removes the user registered under passkey, if any.
+	DeleteUser(passkey string) error
+
+	// RecordSnatch updates u and t's snatch counts to record that u has
+	// finished downloading t.
+	RecordSnatch(u *storage.User, t *storage.Torrent) error
+
+	// ClientWhitelisted reports whether peerIDPrefix is an approved
+	// client, for trackers running in private mode.
+	ClientWhitelisted(peerIDPrefix string) (bool, error)
+
+	// PutClient whitelists peerIDPrefix as an approved client.
+	PutClient(peerIDPrefix string) error
+
+	// DeleteClient removes peerIDPrefix from the client whitelist.
+	DeleteClient(peerIDPrefix string) error
+}
+
+// Driver is implemented by storage backends that register themselves
+// with this package so they can be selected by name from a Config.
+type Driver interface {
+	// New opens a Conn using conf.
+	New(conf *config.Config) (Conn, error)
+}
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]Driver)
+)
+
+// Register makes a storage driver available under name. It is intended to
+// be called from a driver package's init function. Register panics if
+// called twice with the same name, or if driver is nil.
+func Register(name string, driver Driver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	if driver == nil {
+		panic("tracker: Register driver is nil")
+	}
+	if _, dup := drivers[name]; dup {
+		panic("tracker: Register called twice for driver " + name)
+	}
+	drivers[name] = driver
+}
+
+// Open opens a Conn using the driver named by conf.StorageDriver. The
+// driver must have been registered (by blank-importing its package) prior
+// to calling Open.
+func Open(conf *config.Config) (Conn, error) {
+	driversMu.RLock()
+	driver, ok := drivers[conf.StorageDriver]
+	driversMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("tracker: unknown driver %q (forgotten import?)", conf.StorageDriver)
+	}
+	return driver.New(conf)
+}
@@ -0,0 +1,63 @@
+// Copyright 2013 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"errors"
+
+	"github.com/chihaya/chihaya/storage"
+)
+
+// ErrUnknownUser is returned by ValidateAnnounce when a private tracker
+// receives an announce for a passkey with no registered user.
+var ErrUnknownUser = errors.New("tracker: unknown passkey")
+
+// ErrUnapprovedClient is returned by ValidateAnnounce when a private
+// tracker receives an announce from a peer ID whose client prefix is not
+// on the whitelist.
+var ErrUnapprovedClient = errors.New("tracker: client not whitelisted")
+
+// clientPrefixLen is the number of leading bytes of a peer ID that
+// identify its client, following the convention of the Azureus-style
+// ("-XX0000-...") and Shadow-style peer ID conventions.
+const clientPrefixLen = 8
+
+// ClientPrefix returns the client-identifying prefix of peerID, used to
+// key the client whitelist.
+func ClientPrefix(peerID string) string {
+	if len(peerID) < clientPrefixLen {
+		return peerID
+	}
+	return peerID[:clientPrefixLen]
+}
+
+// ValidateAnnounce enforces private-tracker mode: when private is false
+// it is a no-op returning a nil user. When private is true, it looks up
+// the user registered under passkey and checks that peerID belongs to a
+// whitelisted client, returning ErrUnknownUser or ErrUnapprovedClient if
+// either check fails.
+func ValidateAnnounce(conn Conn, private bool, passkey, peerID string) (*storage.User, error) {
+	if !private {
+		return nil, nil
+	}
+
+	user, ok, err := conn.FindUser(passkey)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+
+	whitelisted, err := conn.ClientWhitelisted(ClientPrefix(peerID))
+	if err != nil {
+		return nil, err
+	}
+	if !whitelisted {
+		return nil, ErrUnapprovedClient
+	}
+
+	return user, nil
+}